@@ -0,0 +1,342 @@
+// collectors of subsystem metrics and the scrape coordinator
+
+package exporter
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	logtax "log"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	CollectorBusyErr = errors.New("previous update still running")
+	// static, flags are parsed before collectors can be created
+	collectorNames = []string{"cpu", "loadavg", "meminfo", "memory", "processcpu", "strace"}
+)
+
+// collector refreshes the metrics of a subsystem, and describes and
+// collects the vecs of the subsystem it owns
+type Collector interface {
+	prometheus.Collector
+	// ctx is done when the collector timeout expires or on shutdown
+	Update(ctx context.Context) error
+}
+
+// scrape coordinator runs all collectors concurrently on every scrape
+// and exposes the union of their metrics as a single prometheus.Collector
+type ScrapeCoordinator struct {
+	names      []string
+	collectors map[string]Collector
+	timeouts   map[string]time.Duration
+	mtx        sync.Mutex
+	running    map[string]bool // collectors still updating after a timeout
+	wg         sync.WaitGroup  // running collector updates
+}
+
+type cpuCollector struct {
+	cpu *CpuInfo
+}
+
+type loadavgCollector struct {
+	cpu *CpuInfo
+}
+
+type processCpuCollector struct {
+	cpu *CpuInfo
+}
+
+type meminfoCollector struct {
+	memory *MemoryInfo
+}
+
+type memoryCollector struct {
+	memory *MemoryInfo
+}
+
+type straceCollector struct {
+	memory *MemoryInfo
+	ctx    context.Context // shutdown ctx, strace outlives the update deadline
+	wg     sync.WaitGroup  // running strace processes
+}
+
+// collector with work outliving its update, waited for on shutdown
+type waitingCollector interface {
+	Wait()
+}
+
+// create a collector by name, ctx is done on shutdown
+func NewCollector(ctx context.Context, name string) (Collector, error) {
+	switch name {
+	case "cpu":
+		return &cpuCollector{cpu: CpuOb}, nil
+	case "loadavg":
+		return &loadavgCollector{cpu: CpuOb}, nil
+	case "processcpu":
+		return &processCpuCollector{cpu: CpuOb}, nil
+	case "meminfo":
+		return &meminfoCollector{memory: MemoryOb}, nil
+	case "memory":
+		return &memoryCollector{memory: MemoryOb}, nil
+	case "strace":
+		return &straceCollector{memory: MemoryOb, ctx: ctx}, nil
+	}
+	return nil, errors.New("unsupport collector " + name)
+}
+
+// timeouts are the deadlines of every collector update, ctx is done on
+// shutdown
+func NewScrapeCoordinator(ctx context.Context, names []string, timeouts map[string]time.Duration) (*ScrapeCoordinator, error) {
+	coordinator := &ScrapeCoordinator{
+		names:      names,
+		collectors: make(map[string]Collector, len(names)),
+		timeouts:   timeouts,
+		running:    make(map[string]bool, len(names)),
+	}
+
+	for _, name := range names {
+		collector, err := NewCollector(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		coordinator.collectors[name] = collector
+	}
+
+	return coordinator, nil
+}
+
+// run every collector and wait for all of them, each at most its timeout,
+// duration and success are recorded per collector
+func (coordinator *ScrapeCoordinator) Update(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, name := range coordinator.names {
+		wg.Add(1)
+		go func(name string, collector Collector) {
+			defer wg.Done()
+			start := time.Now()
+			err := coordinator.update(ctx, name, collector)
+			collectorDurationGaugeVec.WithLabelValues(name).Set(time.Since(start).Seconds())
+			if err != nil {
+				collectorSuccessGaugeVec.WithLabelValues(name).Set(0)
+				collectorErrorsCounterVec.WithLabelValues(name, collectorErrorReason(err)).Inc()
+				logtax.Println(name + ": " + err.Error())
+				return
+			}
+			collectorSuccessGaugeVec.WithLabelValues(name).Set(1)
+		}(name, coordinator.collectors[name])
+	}
+	wg.Wait()
+}
+
+// update a collector within its timeout, a collector ignoring the
+// deadline is left running and fails as busy until it returns
+func (coordinator *ScrapeCoordinator) update(ctx context.Context, name string, collector Collector) error {
+	coordinator.mtx.Lock()
+	if coordinator.running[name] {
+		coordinator.mtx.Unlock()
+		return CollectorBusyErr
+	}
+	coordinator.running[name] = true
+	coordinator.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, coordinator.timeouts[name])
+	defer cancel()
+
+	result := make(chan error, 1)
+	coordinator.wg.Add(1)
+	go func() {
+		defer coordinator.wg.Done()
+		err := collector.Update(ctx)
+		coordinator.mtx.Lock()
+		coordinator.running[name] = false
+		coordinator.mtx.Unlock()
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait for collector updates left running after their timeout and for
+// work outliving the updates, at most the longest collector timeout,
+// Update must not be called concurrently
+func (coordinator *ScrapeCoordinator) Wait() {
+	var timeout time.Duration
+	for _, name := range coordinator.names {
+		if coordinator.timeouts[name] > timeout {
+			timeout = coordinator.timeouts[name]
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		coordinator.wg.Wait()
+		for _, name := range coordinator.names {
+			if collector, ok := coordinator.collectors[name].(waitingCollector); ok {
+				collector.Wait()
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logtax.Println(CollectorBusyErr.Error() + " on shutdown, not waited for")
+	}
+}
+
+// coarse reason of a collector error
+func collectorErrorReason(err error) string {
+	var (
+		pathErr  *os.PathError
+		execErr  *exec.Error
+		exitErr  *exec.ExitError
+		parseErr *strconv.NumError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, CollectorBusyErr):
+		return "busy"
+	case errors.Is(err, NoMemoryBackendAvailableErr):
+		return "no_backend"
+	case errors.As(err, &execErr), errors.As(err, &exitErr):
+		return "exec"
+	case errors.As(err, &pathErr):
+		return "read"
+	case errors.As(err, &parseErr):
+		return "parse"
+	}
+	return "other"
+}
+
+// collectors of different subsystems may describe the same metric name,
+// e.g. workload_usage_gauge of cpu and memory, with distinct label values
+func (coordinator *ScrapeCoordinator) Describe(ch chan<- *prometheus.Desc) {
+	for _, name := range coordinator.names {
+		coordinator.collectors[name].Describe(ch)
+	}
+}
+
+func (coordinator *ScrapeCoordinator) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range coordinator.names {
+		coordinator.collectors[name].Collect(ch)
+	}
+}
+
+func describeMetrics(ch chan<- *prometheus.Desc, metrics ...prometheus.Collector) {
+	for _, metric := range metrics {
+		metric.Describe(ch)
+	}
+}
+
+func collectMetrics(ch chan<- prometheus.Metric, metrics ...prometheus.Collector) {
+	for _, metric := range metrics {
+		metric.Collect(ch)
+	}
+}
+
+func (collector *cpuCollector) Describe(ch chan<- *prometheus.Desc) {
+	describeMetrics(ch, collector.cpu.usageVec, collector.cpu.coreUsageVec, collector.cpu.physicalCpuNumVec, collector.cpu.cpuInfoVec)
+}
+
+func (collector *cpuCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, collector.cpu.usageVec, collector.cpu.coreUsageVec, collector.cpu.physicalCpuNumVec, collector.cpu.cpuInfoVec)
+}
+
+func (collector *cpuCollector) Update(ctx context.Context) error {
+	return collector.cpu.CalCpuUsage()
+}
+
+func (collector *loadavgCollector) metrics() []prometheus.Collector {
+	metrics := []prometheus.Collector{collector.cpu.loadAverageVec, collector.cpu.schedulerEntitiesVec, collector.cpu.lastPidVec}
+	if collector.cpu.loadAverageHistogramVec != nil {
+		metrics = append(metrics, collector.cpu.loadAverageHistogramVec)
+	}
+	return metrics
+}
+
+func (collector *loadavgCollector) Describe(ch chan<- *prometheus.Desc) {
+	describeMetrics(ch, collector.metrics()...)
+}
+
+func (collector *loadavgCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, collector.metrics()...)
+}
+
+func (collector *loadavgCollector) Update(ctx context.Context) error {
+	return collector.cpu.LoadAverage()
+}
+
+func (collector *processCpuCollector) Describe(ch chan<- *prometheus.Desc) {
+	describeMetrics(ch, collector.cpu.processSeries)
+}
+
+func (collector *processCpuCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, collector.cpu.processSeries)
+}
+
+func (collector *processCpuCollector) Update(ctx context.Context) error {
+	return collector.cpu.ExposeProcessCpuUsage(ctx)
+}
+
+func (collector *meminfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	describeMetrics(ch, collector.memory.memInfoVec, collector.memory.memRatioVec)
+}
+
+func (collector *meminfoCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, collector.memory.memInfoVec, collector.memory.memRatioVec)
+}
+
+func (collector *meminfoCollector) Update(ctx context.Context) error {
+	return collector.memory.ExposeSystemMemInfo()
+}
+
+func (collector *memoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	describeMetrics(ch, collector.memory.usageVec, collector.memory.processSeries, collector.memory.grouper.series)
+}
+
+func (collector *memoryCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, collector.memory.usageVec, collector.memory.processSeries, collector.memory.grouper.series)
+}
+
+func (collector *memoryCollector) Update(ctx context.Context) error {
+	return collector.memory.ExposeUssMemoryUsage(ctx)
+}
+
+func (collector *straceCollector) Describe(ch chan<- *prometheus.Desc) {
+	describeMetrics(ch, collector.memory.straceVec)
+}
+
+func (collector *straceCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, collector.memory.straceVec)
+}
+
+// strace processes queued by the previous scrape, strace runs for
+// seconds so the update does not wait for it, it has its own deadline
+func (collector *straceCollector) Update(ctx context.Context) error {
+	for _, indicator := range collector.memory.dequeueStrace() {
+		collector.wg.Add(1)
+		go func(indicator *Indicator) {
+			defer collector.wg.Done()
+			collector.memory.CollectStraceMetrics(collector.ctx, indicator)
+		}(indicator)
+	}
+	return nil
+}
+
+// strace processes are killed on shutdown, wait for them to exit
+func (collector *straceCollector) Wait() {
+	collector.wg.Wait()
+}
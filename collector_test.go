@@ -0,0 +1,50 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector ignoring ctx, every update blocks until release is closed
+type stubCollector struct {
+	release chan struct{}
+}
+
+func (collector *stubCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (collector *stubCollector) Collect(ch chan<- prometheus.Metric) {}
+
+func (collector *stubCollector) Update(ctx context.Context) error {
+	<-collector.release
+	return nil
+}
+
+func TestScrapeCoordinatorUpdateTimeout(t *testing.T) {
+	stub := &stubCollector{release: make(chan struct{})}
+	coordinator := &ScrapeCoordinator{
+		names:      []string{"stub"},
+		collectors: map[string]Collector{"stub": stub},
+		timeouts:   map[string]time.Duration{"stub": time.Millisecond * 20},
+		running:    make(map[string]bool),
+	}
+	ctx := context.Background()
+
+	err := coordinator.update(ctx, "stub", stub)
+	if reason := collectorErrorReason(err); reason != "timeout" {
+		t.Fatalf("first update error = %v, reason %s, want timeout", err, reason)
+	}
+	// the timed out update is still running
+	err = coordinator.update(ctx, "stub", stub)
+	if reason := collectorErrorReason(err); reason != "busy" {
+		t.Fatalf("second update error = %v, reason %s, want busy", err, reason)
+	}
+
+	close(stub.release)
+	coordinator.wg.Wait()
+	if err := coordinator.update(ctx, "stub", stub); err != nil {
+		t.Errorf("update after the stub returned error = %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+// run subprocesses bound to a context
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// run a command and return its stdout, the whole process group is killed
+// when ctx is done, so children of sh -c pipelines do not keep it hanging
+func commandOutput(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Stdout = &stdout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -3,27 +3,63 @@
 package exporter
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	DefaultScrapeInterval 	= 10
+	DefaultCollectMode      = "ticker"
+	DefaultCollectTimeout   = time.Second * 10
+	DefaultCollectCacheTTL  = time.Second
+	DefaultCollectorTimeout = time.Second * 5
 	DefaultExporter       	= "expose"
+	DefaultMemoryBackend    = "auto"
+	DefaultPushGatewayUrl   = "http://127.0.0.1:9091"
+	DefaultPushGatewayJob   = "gexporter"
+	DefaultPushGatewayMethod = "push"
+	DefaultPushGatewayRetries = 3
+	DefaultRemoteWriteUrl   = "http://127.0.0.1:9090/api/v1/write"
+	DefaultRemoteWriteBatchSize = 500
+	DefaultRemoteWriteQueueSize = 100
+	DefaultRemoteWriteRetries = 3
+	DefaultInfluxUrl        = "http://127.0.0.1:8086/write?db=gexporter"
+	DefaultInfluxBatchSize  = 1000
+	DefaultStatsdAddress    = "udp://127.0.0.1:8125"
+	DefaultStatsdPrefix     = "gexporter."
+	DefaultGraphiteAddress  = "127.0.0.1:2003"
+	DefaultGraphiteTemplate = "gexporter.<host>.<name>.<labels>"
+	DefaultGraphiteBufferSize = 10000
+	DefaultOtlpUrl          = "http://127.0.0.1:4318/v1/metrics"
+	DefaultOtlpRetries      = 3
+	DefaultTextfileDirectory = "/var/lib/node_exporter/textfile_collector"
+	DefaultTextfileName     = "gexporter.prom"
 	MaxCollectProcessNum  	= 50
+	DefaultTopProcessNum    = 10
+	DefaultRankBy           = "pss"
+	DefaultProcessGroupBy   = "none"
+	DefaultProcessLabelMaxSeries = 100
 	HighUsageCpuThreshold   = 40.0
 	HighUsageMemThreshold   = 50.0
 	MetricsHttpPath       	= "/metrics"
 	MetricsHttpPort       	= "80"
 	TargetOs              	= "linux"
 	StraceAttachTime      	= 5
+	straceKillGrace         = 5
 	StraceOutputFile      	= "/data/logs/exporter_strace_%d.log"
 	straceOutputEnd         = "------"
 	excludeSelfProcess      = "gexporter_main"
 )
 
 type Config interface {
-	parseConfig()
+	parseConfig(fs *flag.FlagSet, args []string)
 	getConfig()   *ConfigValues
 }
 
@@ -37,26 +73,107 @@ var (
 	//configNames = []string{"exporter", "scrape_interval", "max_process_num"}
 )
 
-func NewExporterConfig() *GExporterConfig {
+// flags are defined on fs, the command line for the exporter and a
+// fresh flag set for tests
+func NewExporterConfig(fs *flag.FlagSet, args []string) *GExporterConfig {
 	gec := &GExporterConfig{
 		Configs: make(ConfigValues),
 	}
-	gec.parseConfig()
+	gec.parseConfig(fs, args)
 
 	return gec
 }
 
-func (config *GExporterConfig) parseConfig() {
-	exporter := flag.String("exporter", DefaultExporter, "exporter fashion")
-	maxProcessNum := flag.Int("max-process-num", MaxCollectProcessNum, "max process num")
-	scrapeInterval := flag.Int("scrape-interval", DefaultScrapeInterval, "scraping interval")
-	promHttpPort := flag.Int("prom-http-port", 80, "prom http server port")
-	flag.Parse()
+func (config *GExporterConfig) parseConfig(fs *flag.FlagSet, args []string) {
+	exporter := fs.String("exporter", DefaultExporter, "exporter fashions separated by ,")
+	maxProcessNum := fs.Int("max-process-num", MaxCollectProcessNum, "max process num")
+	scrapeInterval := fs.Int("scrape-interval", DefaultScrapeInterval, "scraping interval")
+	collectMode := fs.String("collect-mode", DefaultCollectMode, "collect every scrape interval, or on every /metrics request, ticker|scrape")
+	collectTimeout := fs.Duration("collect-timeout", DefaultCollectTimeout, "max wait of a /metrics request for its collection in scrape mode")
+	collectCacheTTL := fs.Duration("collect-cache-ttl", DefaultCollectCacheTTL, "reuse a collection within the ttl in scrape mode")
+	promHttpPort := fs.Int("prom-http-port", 80, "prom http server port")
+	pushGatewayUrl := fs.String("pushgateway-url", DefaultPushGatewayUrl, "pushgateway url")
+	pushGatewayJob := fs.String("pushgateway-job", DefaultPushGatewayJob, "pushgateway job grouping key")
+	pushGatewayInstance := fs.String("pushgateway-instance", defaultInstance(), "pushgateway instance grouping key")
+	pushGatewayMethod := fs.String("pushgateway-method", DefaultPushGatewayMethod, "push replaces the whole group, add only metrics with the same name, push|add")
+	pushGatewayRetries := fs.Int("pushgateway-retries", DefaultPushGatewayRetries, "pushgateway push retries")
+	pushGatewayDeleteOnShutdown := fs.Bool("pushgateway-delete-on-shutdown", false, "delete pushed metrics on shutdown")
+	remoteWriteUrl := fs.String("remote-write-url", DefaultRemoteWriteUrl, "remote write endpoint")
+	remoteWriteHeaders := fs.String("remote-write-headers", "", "remote write extra headers, name=value separated by ,")
+	remoteWriteInstance := fs.String("remote-write-instance", defaultInstance(), "instance label added to remote written series")
+	remoteWriteBatchSize := fs.Int("remote-write-batch-size", DefaultRemoteWriteBatchSize, "max samples per remote write request")
+	remoteWriteQueueSize := fs.Int("remote-write-queue-size", DefaultRemoteWriteQueueSize, "max pending remote write requests")
+	remoteWriteRetries := fs.Int("remote-write-retries", DefaultRemoteWriteRetries, "remote write retries")
+	influxUrl := fs.String("influx-url", DefaultInfluxUrl, "influxdb write url, http(s)://host/write?db=name, http(s)://host/api/v2/write?org=o&bucket=b or udp://host:port")
+	influxHost := fs.String("influx-host", defaultInstance(), "host tag of influx lines")
+	influxBatchSize := fs.Int("influx-batch-size", DefaultInfluxBatchSize, "max lines per influx request or packet")
+	statsdAddress := fs.String("statsd-address", DefaultStatsdAddress, "statsd agent address, udp://host:port or unixgram:///path")
+	statsdPrefix := fs.String("statsd-prefix", DefaultStatsdPrefix, "prefix of statsd metric names")
+	statsdSampleRate := fs.Float64("statsd-sample-rate", 1, "statsd sample rate, (0, 1]")
+	statsdTags := fs.Bool("statsd-tags", false, "send labels as dogstatsd tags instead of metric name parts")
+	graphiteAddress := fs.String("graphite-address", DefaultGraphiteAddress, "carbon plaintext tcp address")
+	graphiteHost := fs.String("graphite-host", defaultInstance(), "value of <host> in graphite templates")
+	graphiteTemplate := fs.String("graphite-template", DefaultGraphiteTemplate, "graphite path template, <name> <host> <labels> or <label name> placeholders")
+	graphiteTemplates := fs.String("graphite-templates", "", "per metric graphite templates, metric=template;...")
+	graphiteBufferSize := fs.Int("graphite-buffer-size", DefaultGraphiteBufferSize, "max graphite lines kept while carbon is down")
+	otlpUrl := fs.String("otlp-url", DefaultOtlpUrl, "otlp/http metrics endpoint")
+	otlpHeaders := fs.String("otlp-headers", "", "otlp extra headers, name=value separated by ,")
+	otlpHost := fs.String("otlp-host", defaultInstance(), "host.name resource attribute of otlp metrics")
+	otlpRetries := fs.Int("otlp-retries", DefaultOtlpRetries, "retries of failed otlp exports")
+	textfileDirectory := fs.String("textfile-directory", DefaultTextfileDirectory, "directory of node_exporter textfile collector")
+	textfileName := fs.String("textfile-name", DefaultTextfileName, "name of the written .prom file")
+	memoryBackend := fs.String("memory-backend", DefaultMemoryBackend, "per process memory backend, auto|procfs|smem|ps")
+	topProcessNum := fs.Int("top-process-num", DefaultTopProcessNum, "num of ranked processes")
+	rankBy := fs.String("rank-by", DefaultRankBy, "process ranking key, uss|pss|rss|swap|cpu")
+	processGroupBy := fs.String("process-group-by", DefaultProcessGroupBy, "process grouping, none|name|user|rule")
+	processGroupRules := fs.String("process-group-rules", "", "process group rules, name=regex separated by ;")
+	processLabels := fs.Bool("process-labels", false, "add command and pid labels to process metrics")
+	processLabelMaxSeries := fs.Int("process-label-max-series", DefaultProcessLabelMaxSeries, "max series of process metrics per type, 0 for unlimited")
+	loadAverageHistogram := fs.Bool("load-average-histogram", false, "also expose load average as histogram")
+	collectorTimeout := fs.Duration("collector-timeout", DefaultCollectorTimeout, "max duration of a collector update, a timed out collector fails")
+	configFile := fs.String("config-file", "", "json config file, keys are flag names, command line flags take precedence")
+	enableCollectors := make(map[string]*bool, len(collectorNames))
+	disableCollectors := make(map[string]*bool, len(collectorNames))
+	collectorTimeouts := make(map[string]*time.Duration, len(collectorNames))
+	for _,name := range collectorNames {
+		enableCollectors[name] = fs.Bool("collector." + name, true, "enable the " + name + " collector")
+		disableCollectors[name] = fs.Bool("no-collector." + name, false, "disable the " + name + " collector")
+		collectorTimeouts[name] = fs.Duration("collector." + name + ".timeout", 0, "timeout of the " + name + " collector, -collector-timeout if 0")
+	}
+	if err := fs.Parse(args);err != nil {
+		panic(err)
+	}
+
+	if *configFile != "" {
+		if err := applyConfigFile(fs, *configFile);err != nil {
+			panic(err)
+		}
+	}
+
+	enabledCollectors := make([]string, 0, len(collectorNames))
+	for _,name := range collectorNames {
+		if *enableCollectors[name] && !*disableCollectors[name] {
+			enabledCollectors = append(enabledCollectors, name)
+		}
+	}
+	config.Configs["collectors"] = enabledCollectors
 
-	if *exporter != "pushgateway" && *exporter != "expose" {
-		panic(errors.New("unsupport exporter"))
+	timeouts := make(map[string]time.Duration, len(collectorNames))
+	for _,name := range collectorNames {
+		timeouts[name] = *collectorTimeout
+		if *collectorTimeouts[name] != 0 {
+			timeouts[name] = *collectorTimeouts[name]
+		}
+		if timeouts[name] <= 0 {
+			panic(errors.New("collector timeout must be positive"))
+		}
+	}
+	config.Configs["collector_timeouts"] = timeouts
+
+	if exporters, err := ParseSinkNames(*exporter);err != nil {
+		panic(err)
 	} else {
-		config.Configs["exporter"] = *exporter
+		config.Configs["exporter"] = exporters
 	}
 
 	if *maxProcessNum > 2000 {
@@ -71,11 +188,252 @@ func (config *GExporterConfig) parseConfig() {
 		config.Configs["scrape_interval"] = *scrapeInterval
 	}
 
+	if *collectMode != "ticker" && *collectMode != "scrape" {
+		panic(errors.New("unsupport collect mode"))
+	} else if exporters := config.Configs["exporter"].([]string);*collectMode == "scrape" && (len(exporters) != 1 || exporters[0] != "expose") {
+		panic(errors.New("collect mode scrape only supports the expose exporter"))
+	} else {
+		config.Configs["collect_mode"] = *collectMode
+	}
+
+	if *collectTimeout <= 0 || *collectCacheTTL < 0 {
+		panic(errors.New("collect timeout must be positive and cache ttl not negative"))
+	} else {
+		config.Configs["collect_timeout"] = *collectTimeout
+		config.Configs["collect_cache_ttl"] = *collectCacheTTL
+	}
+
 	if *promHttpPort > 1<<0x10 {
 		panic(errors.New("port too large"))
 	} else {
 		config.Configs["prom_http_port"] = *promHttpPort
 	}
+
+	config.Configs["load_average_histogram"] = *loadAverageHistogram
+
+	if *pushGatewayUrl == "" || *pushGatewayJob == "" {
+		panic(errors.New("pushgateway url and job required"))
+	} else {
+		config.Configs["pushgateway_url"] = *pushGatewayUrl
+		config.Configs["pushgateway_job"] = *pushGatewayJob
+		config.Configs["pushgateway_instance"] = *pushGatewayInstance
+	}
+
+	if *pushGatewayMethod != "push" && *pushGatewayMethod != "add" {
+		panic(errors.New("unsupport pushgateway method"))
+	} else {
+		config.Configs["pushgateway_method"] = *pushGatewayMethod
+	}
+
+	if *pushGatewayRetries < 0 {
+		panic(errors.New("pushgateway retries must not be negative"))
+	} else {
+		config.Configs["pushgateway_retries"] = *pushGatewayRetries
+	}
+
+	config.Configs["pushgateway_delete_on_shutdown"] = *pushGatewayDeleteOnShutdown
+
+	if headers, err := ParseHttpHeaders(*remoteWriteHeaders);err != nil {
+		panic(err)
+	} else if *remoteWriteUrl == "" {
+		panic(errors.New("remote write url required"))
+	} else {
+		config.Configs["remote_write_url"] = *remoteWriteUrl
+		config.Configs["remote_write_headers"] = headers
+		config.Configs["remote_write_instance"] = *remoteWriteInstance
+	}
+
+	if *remoteWriteBatchSize < 1 || *remoteWriteQueueSize < 1 || *remoteWriteRetries < 0 {
+		panic(errors.New("remote write batch size and queue size must be positive, retries not negative"))
+	} else {
+		config.Configs["remote_write_batch_size"] = *remoteWriteBatchSize
+		config.Configs["remote_write_queue_size"] = *remoteWriteQueueSize
+		config.Configs["remote_write_retries"] = *remoteWriteRetries
+	}
+
+	if *topProcessNum < 1 || *topProcessNum > config.Configs["max_process_num"].(int) {
+		panic(errors.New("top process num must between 1 and max process num"))
+	} else {
+		config.Configs["top_process_num"] = *topProcessNum
+	}
+
+	switch *rankBy {
+	case "uss", "pss", "rss", "swap", "cpu":
+		config.Configs["rank_by"] = *rankBy
+	default:
+		panic(errors.New("unsupport rank key"))
+	}
+
+	switch *processGroupBy {
+	case "none", "name", "user", "rule":
+		config.Configs["process_group_by"] = *processGroupBy
+	default:
+		panic(errors.New("unsupport process grouping"))
+	}
+
+	if rules, err := ParseProcessGroupRules(*processGroupRules);err != nil {
+		panic(err)
+	} else if *processGroupBy == "rule" && len(rules) == 0 {
+		panic(errors.New("process group rules required when grouping by rule"))
+	} else {
+		config.Configs["process_group_rules"] = rules
+	}
+
+	config.Configs["process_labels"] = *processLabels
+	if *processLabelMaxSeries < 0 {
+		panic(errors.New("process label max series must not be negative"))
+	} else {
+		config.Configs["process_label_max_series"] = *processLabelMaxSeries
+	}
+
+	if u, err := url.Parse(*influxUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") {
+		panic(errors.New("influx url must be http, https or udp"))
+	} else {
+		config.Configs["influx_url"] = *influxUrl
+		config.Configs["influx_host"] = *influxHost
+	}
+
+	if *influxBatchSize < 1 {
+		panic(errors.New("influx batch size must be positive"))
+	} else {
+		config.Configs["influx_batch_size"] = *influxBatchSize
+	}
+
+	if u, err := url.Parse(*statsdAddress); err != nil || (u.Scheme != "udp" && u.Scheme != "unixgram") {
+		panic(errors.New("statsd address must be udp or unixgram"))
+	} else {
+		config.Configs["statsd_address"] = *statsdAddress
+		config.Configs["statsd_prefix"] = *statsdPrefix
+		config.Configs["statsd_tags"] = *statsdTags
+	}
+
+	if *statsdSampleRate <= 0 || *statsdSampleRate > 1 {
+		panic(errors.New("statsd sample rate must be in (0, 1]"))
+	} else {
+		config.Configs["statsd_sample_rate"] = *statsdSampleRate
+	}
+
+	if *graphiteTemplate == "" {
+		panic(errors.New("graphite template required"))
+	} else {
+		config.Configs["graphite_address"] = *graphiteAddress
+		config.Configs["graphite_host"] = *graphiteHost
+		config.Configs["graphite_template"] = *graphiteTemplate
+	}
+
+	if templates, err := ParseGraphiteTemplates(*graphiteTemplates); err != nil {
+		panic(err)
+	} else {
+		config.Configs["graphite_templates"] = templates
+	}
+
+	if *graphiteBufferSize < 1 {
+		panic(errors.New("graphite buffer size must be positive"))
+	} else {
+		config.Configs["graphite_buffer_size"] = *graphiteBufferSize
+	}
+
+	if headers, err := ParseHttpHeaders(*otlpHeaders); err != nil {
+		panic(err)
+	} else if u, err := url.Parse(*otlpUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		panic(errors.New("otlp url must be http or https"))
+	} else {
+		config.Configs["otlp_url"] = *otlpUrl
+		config.Configs["otlp_headers"] = headers
+		config.Configs["otlp_host"] = *otlpHost
+	}
+
+	if *otlpRetries < 0 {
+		panic(errors.New("otlp retries must not be negative"))
+	} else {
+		config.Configs["otlp_retries"] = *otlpRetries
+	}
+
+	if *textfileDirectory == "" {
+		panic(errors.New("textfile directory required"))
+	} else if !strings.HasSuffix(*textfileName, ".prom") || strings.Contains(*textfileName, "/") {
+		panic(errors.New("textfile name must be a file name ending with .prom"))
+	} else {
+		config.Configs["textfile_directory"] = *textfileDirectory
+		config.Configs["textfile_name"] = *textfileName
+	}
+
+	if *memoryBackend != "auto" && *memoryBackend != "procfs" && *memoryBackend != "smem" && *memoryBackend != "ps" {
+		panic(errors.New("unsupport memory backend"))
+	} else {
+		config.Configs["memory_backend"] = *memoryBackend
+	}
+}
+
+// set flags not given on the command line from a json file like
+// {"scrape-interval": 15, "collector.strace": false}
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(content, &values);err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name,value := range values {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config file %s: unknown flag %s", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		flagValue, err := configFileFlagValue(value)
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %v", path, name, err)
+		}
+		if err := fs.Set(name, flagValue);err != nil {
+			return fmt.Errorf("config file %s: %s: %v", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+// flag value of a json scalar, numbers are never in exponent form so
+// integer flags accept them, arrays, objects and null are rejected
+func configFileFlagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("value must be a string, number or bool, got %s", jsonTypeName(value))
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// whether a collector is enabled
+func collectorEnabled(name string) bool {
+	for _,enabled := range gExporterConfig.Configs["collectors"].([]string) {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (config *GExporterConfig) getConfig(configName string) interface{} {
@@ -1,10 +1,11 @@
 package exporter
 
 import (
-	"fmt"
+	"context"
 	"github.com/prometheus/client_golang/prometheus"
-	"os/exec"
-	"regexp"
+	logtax "log"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,13 +19,41 @@ var (
 
 // cpu info struct
 type CpuInfo struct {
-	PhysicalCpuNum           uint8  // 物理处理器数量
+	PhysicalCpuNum           int    // 物理处理器数量
 	ModelName   		     string // 处理器型号
-	CoresNum    		     uint8  // 核数量
-	SiblingsNum 		     uint8  // 逻辑处理器数量
+	CoresNum    		     int    // 核数量
+	SiblingsNum 		     int    // 逻辑处理器数量
 	SupportHT                bool   // support HT
-	VirtualAddressSize       uint64  // virtual memory space size
-	CpuCacheSize             uint64 // cpu level cache size
+	VirtualAddressSize       uint64 // virtual address size in bits
+	CpuCacheSize             uint64 // cpu level cache size in KB
+	sampler                  *CpuSampler
+	processSampler           *ProcessCpuSampler
+	// vecs of the cpu collector
+	usageVec                 *prometheus.GaugeVec
+	coreUsageVec             *prometheus.GaugeVec
+	physicalCpuNumVec        *prometheus.GaugeVec
+	cpuInfoVec               *prometheus.GaugeVec
+	// vecs of the loadavg collector, the histogram is nil unless enabled
+	loadAverageVec           *prometheus.GaugeVec
+	loadAverageHistogramVec  *prometheus.HistogramVec
+	schedulerEntitiesVec     *prometheus.GaugeVec
+	lastPidVec               *prometheus.GaugeVec
+	// ranked series of the processcpu collector
+	processSeries            *SeriesTracker
+}
+
+// cpu sampler keeps the previous /proc/stat snapshot between scrapes
+type CpuSampler struct {
+	mtx   sync.Mutex
+	prev  *ProcStat
+}
+
+// process cpu sampler keeps utime+stime of every process between scrapes
+type ProcessCpuSampler struct {
+	mtx       sync.Mutex
+	prev      map[int32]*ProcessStat
+	prevTime  time.Time
+	usage     map[int32]float64 // cpu usage of the last sample
 }
 
 type CpuStat struct {
@@ -32,17 +61,18 @@ type CpuStat struct {
 	ProcessorId  		uint8
 }
 
+// load average buckets scaled by logical cpu num
 func (cpu *CpuInfo) GetLoadAverageBucket() (buckets []float64) {
 	buckets = make([]float64, 0)
 	// bucket range
-	buckets = append(buckets, cpu.PCpuNumfloat64() / 40.0)
-	buckets = append(buckets, cpu.PCpuNumfloat64() / 20.0)
-	buckets = append(buckets, cpu.PCpuNumfloat64() / 10.0)
-	buckets = append(buckets, cpu.PCpuNumfloat64() / 5.0)
-	buckets = append(buckets, cpu.PCpuNumfloat64() / 4.0)
-	buckets = append(buckets, cpu.PCpuNumfloat64() / 2.0)
-	buckets = append(buckets, cpu.PCpuNumfloat64())
-	buckets = append(buckets, cpu.PCpuNumfloat64() * loadAverageWorkConstant)
+	buckets = append(buckets, cpu.LCpuNumfloat64() / 40.0)
+	buckets = append(buckets, cpu.LCpuNumfloat64() / 20.0)
+	buckets = append(buckets, cpu.LCpuNumfloat64() / 10.0)
+	buckets = append(buckets, cpu.LCpuNumfloat64() / 5.0)
+	buckets = append(buckets, cpu.LCpuNumfloat64() / 4.0)
+	buckets = append(buckets, cpu.LCpuNumfloat64() / 2.0)
+	buckets = append(buckets, cpu.LCpuNumfloat64())
+	buckets = append(buckets, cpu.LCpuNumfloat64() * loadAverageWorkConstant)
 
 	return
 }
@@ -52,96 +82,282 @@ func (cpu *CpuInfo) PCpuNumfloat64() float64 {
 	return float64(cpu.PhysicalCpuNum)
 }
 
-// observe load average
-func (cpu *CpuInfo) LoadAverage() {
-	defer timeUseCondition()
-	load := cpu.getLoadAverage()
-	for r,v := range load {
-		loadAverageHistogramVec.WithLabelValues(r).Observe(v)
-	}
+// logical cpu num convert to float64
+func (cpu *CpuInfo) LCpuNumfloat64() float64 {
+	return float64(cpu.SiblingsNum)
 }
 
-// get load average
-func (cpu *CpuInfo) getLoadAverage() (loadAverage map[string]float64) {
-	loadAverage = make(map[string]float64)
-	statistic,_ := exec.Command("sh", "-c", `uptime | grep -o -E 'load average:(.*)' | awk '{print $3 $4 $5}'`).Output()
-	result := strings.Split(strings.Trim(string(statistic), "\n"), ",")
-	for k,r := range []string{"1", "5", "15"} {
-		loadAverage[r],_ = strconv.ParseFloat(result[k], 64)
+// expose load average and task counts
+func (cpu *CpuInfo) LoadAverage() error {
+	load, err := ReadLoadAvg()
+	if err != nil {
+		return err
 	}
 
-	return
+	loads := map[string]float64{"1": load.Load1, "5": load.Load5, "15": load.Load15}
+	for r,v := range loads {
+		cpu.loadAverageVec.WithLabelValues(r).Set(v)
+	}
+	// optional histogram view
+	if cpu.loadAverageHistogramVec != nil {
+		for r,v := range loads {
+			cpu.loadAverageHistogramVec.WithLabelValues(r).Observe(v)
+		}
+	}
+
+	cpu.schedulerEntitiesVec.WithLabelValues("running").Set(float64(load.RunningTasks))
+	cpu.schedulerEntitiesVec.WithLabelValues("total").Set(float64(load.TotalTasks))
+	cpu.lastPidVec.WithLabelValues().Set(float64(load.LastPid))
+
+	return nil
 }
 
 // calculate cpu usage within 100% percent
-func (cpu *CpuInfo) CalCpuUsage() {
-	defer timeUseCondition()
-	dataSample := make([]map[string]float64, 0)
-	wg := sync.WaitGroup{}
+// usage is the delta against the snapshot of the previous scrape
+func (cpu *CpuInfo) CalCpuUsage() error {
+	prev, cur, err := cpu.sampler.Sample()
+	if err != nil {
+		return err
+	}
+	if prev == nil {
+		return nil
+	}
 
-	for i := 0;i < 2;i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			dataSample = append(dataSample, cpu.getCpuStatDetail(1))
-		}(i)
-		time.Sleep(time.Millisecond * 2000)
+	for f,v := range cpuUsageRatio(prev.Total, cur.Total) {
+		cpu.usageVec.With(prometheus.Labels{"type": "cpu", "subtype": f}).Set(v)
 	}
-	wg.Wait()
+	cpu.exposeCoreUsage(prev, cur)
 
-	for _,f := range cpuUsageType {
-		usageGaugeVec.With(prometheus.Labels{"type": "cpu", "subtype": f}).Set((dataSample[0][f] - dataSample[1][f]) / (dataSample[0]["total"] - dataSample[1]["total"]))
+	return nil
+}
+
+// expose usage of every cpuN line
+func (cpu *CpuInfo) exposeCoreUsage(prev *ProcStat, cur *ProcStat) {
+	prevCores := make(map[string]CpuTimes, len(prev.Cpus))
+	for _,times := range prev.Cpus {
+		prevCores[times.Cpu] = times
 	}
 
-	usageGaugeVec.With(prometheus.Labels{"type": "cpu", "subtype": "total"}).Set(1 - ((dataSample[0]["idle"] - dataSample[1]["idle"]) / (dataSample[0]["total"] - dataSample[1]["total"])))
+	for _,times := range cur.Cpus {
+		prevTimes, ok := prevCores[times.Cpu]
+		if !ok {
+			// cpu went online between samples
+			continue
+		}
+		core := strings.TrimPrefix(times.Cpu, "cpu")
+		for f,v := range cpuUsageRatio(prevTimes, times) {
+			cpu.coreUsageVec.With(prometheus.Labels{"cpu": core, "subtype": f}).Set(v)
+		}
+	}
 }
 
-// get cpu usage detail
-func (cpu *CpuInfo) getCpuStatDetail(line int) (detail map[string]float64) {
-	detail = make(map[string]float64)
-	cpuStatCmd := exec.Command("sh", "-c", fmt.Sprintf("cat /proc/stat | awk 'NR==%d {$1=null;print $0}'", line))
-	o,_ := cpuStatCmd.Output()
-	cpuStat := regexp.MustCompile(`\s+`).ReplaceAllString(string(o), " ")
-	cpuStatSlice := strings.Split(cpuStat, " ")
+// usage ratio of every cpuUsageType and total between two samples
+func cpuUsageRatio(prev CpuTimes, cur CpuTimes) (usage map[string]float64) {
+	usage = make(map[string]float64)
+	total := cur.Total() - prev.Total()
+	if total <= 0 {
+		return
+	}
 
-	var (
-		i = 1
-		total float64
-	)
 	for _,f := range cpuUsageType {
-		detail[f],_ = strconv.ParseFloat(cpuStatSlice[i], 64)
-		total += detail[f]
-		i++
+		usage[f] = (cur.Get(f) - prev.Get(f)) / total
 	}
-	detail["total"] = total
+	usage["total"] = 1 - usage["idle"]
 
 	return
 }
 
+// take a new snapshot, return it with the previous one
+// prev is nil on the first call
+func (sampler *CpuSampler) Sample() (prev *ProcStat, cur *ProcStat, err error) {
+	cur, err = ReadProcStat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sampler.mtx.Lock()
+	prev, sampler.prev = sampler.prev, cur
+	sampler.mtx.Unlock()
+
+	return prev, cur, nil
+}
+
+// sample all processes, cpu usage is the percent of one cpu used
+// since the previous call, like top does
+func (sampler *ProcessCpuSampler) Sample(ctx context.Context) ([]*Indicator, error) {
+	pids, err := ListPids()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	cur := make(map[int32]*ProcessStat, len(pids))
+	for _,pid := range pids {
+		// keep the previous sample, the next one covers a longer interval
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// process may exit while reading
+		if stat, err := ReadProcessStat(pid);err == nil {
+			cur[pid] = stat
+		}
+	}
+
+	// held until usage is computed, so Usage never sees usage of another
+	// sample than prev, and concurrent samples do not interleave
+	sampler.mtx.Lock()
+	defer sampler.mtx.Unlock()
+	prev, prevTime := sampler.prev, sampler.prevTime
+	sampler.prev, sampler.prevTime = cur, now
+
+	indicators := make([]*Indicator, 0)
+	usage := make(map[int32]float64)
+	sampler.usage = usage
+
+	elapsed := now.Sub(prevTime).Seconds()
+	if prev == nil || elapsed <= 0 {
+		return indicators, nil
+	}
+
+	for pid,stat := range cur {
+		prevStat, ok := prev[pid]
+		// new process, or pid reused by another one
+		if !ok || prevStat.StartTime != stat.StartTime {
+			continue
+		}
+		ticks := float64(stat.Utime + stat.Stime) - float64(prevStat.Utime + prevStat.Stime)
+		usage[pid] = ticks / userHz / elapsed * 100
+		indicators = append(indicators, &Indicator{
+			Pid: pid,
+			Command: stat.Comm,
+			CpuUsage: usage[pid],
+		})
+	}
+
+	return indicators, nil
+}
+
+// cpu usage of a process in the last sample
+func (sampler *ProcessCpuSampler) Usage(pid int32) float64 {
+	sampler.mtx.Lock()
+	defer sampler.mtx.Unlock()
+	return sampler.usage[pid]
+}
+
+// expose top cpu usage processes and queue high usage ones for strace
+func (cpu *CpuInfo) ExposeProcessCpuUsage(ctx context.Context) error {
+	indicators, err := cpu.processSampler.Sample(ctx)
+	if err != nil {
+		return err
+	}
+
+	selfPid := int32(os.Getpid())
+	processes := make([]*Indicator, 0, len(indicators))
+	for _,indicator := range indicators {
+		if indicator.Pid == selfPid {
+			continue
+		}
+		MemoryOb.fixCommandName(indicator)
+		if indicator.CpuUsage >= HighUsageCpuThreshold {
+			MemoryOb.queueStrace(indicator)
+		}
+		processes = append(processes, indicator)
+	}
+
+	for rank,indicator := range topIndicators(processes, "cpu") {
+		cpu.processSeries.Set(processLabels(indicator, rank, "cpu"), indicator.CpuUsage)
+	}
+	cpu.processSeries.Flush()
+
+	return nil
+}
+
 // expose physical cpu num
 func (cpu *CpuInfo) ExposePCNum() {
-	pcnGaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "physical_cpu_num",
-		Help: "physical cpu num",
-	}, []string{})
-	prometheus.MustRegister(pcnGaugeVec)
-	pcnGaugeVec.WithLabelValues().Set(cpu.PCpuNumfloat64())
+	cpu.physicalCpuNumVec.WithLabelValues().Set(cpu.PCpuNumfloat64())
+}
+
+// expose cpu topology with model and cache labels
+func (cpu *CpuInfo) ExposeCpuInfo() {
+	cacheSize := strconv.FormatUint(cpu.CpuCacheSize, 10)
+	cpu.cpuInfoVec.WithLabelValues(cpu.ModelName, cacheSize, "sockets").Set(float64(cpu.PhysicalCpuNum))
+	cpu.cpuInfoVec.WithLabelValues(cpu.ModelName, cacheSize, "cores").Set(float64(cpu.CoresNum))
+	cpu.cpuInfoVec.WithLabelValues(cpu.ModelName, cacheSize, "threads").Set(float64(cpu.SiblingsNum))
+}
+
+// fill topology from sysfs, fall back to one socket without HT
+func (cpu *CpuInfo) readTopology() {
+	topology, err := ReadCpuTopology()
+	if err != nil || topology.Threads == 0 {
+		if err != nil {
+			logtax.Println(err.Error())
+		}
+		topology = &CpuTopology{Sockets: 1, Cores: runtime.NumCPU(), Threads: runtime.NumCPU()}
+	}
+
+	cpu.PhysicalCpuNum = topology.Sockets
+	cpu.CoresNum = topology.Cores
+	cpu.SiblingsNum = topology.Threads
+	cpu.SupportHT = topology.Threads > topology.Cores
+}
+
+// fill model name and sizes from /proc/cpuinfo, missing fields are left empty
+func (cpu *CpuInfo) readCpuInfo() {
+	cpuInfo, err := ReadCpuInfo()
+	if err != nil {
+		logtax.Println(err.Error())
+	}
+
+	cpu.ModelName = "unknown"
+	// x86 and newer arm kernels use model name, older arm ones Processor
+	for _,key := range []string{"model name", "Processor", "cpu model"} {
+		if name, ok := cpuInfo[key];ok && name != "" {
+			cpu.ModelName = name
+			break
+		}
+	}
+
+	// e.g. "cache size : 512 KB"
+	if cacheSize := strings.Fields(cpuInfo["cache size"]);len(cacheSize) > 0 {
+		cpu.CpuCacheSize,_ = strconv.ParseUint(cacheSize[0], 10, 64)
+	}
+	// e.g. "address sizes : 46 bits physical, 48 bits virtual"
+	for _,size := range strings.Split(cpuInfo["address sizes"], ",") {
+		if fields := strings.Fields(size);len(fields) == 3 && fields[2] == "virtual" {
+			cpu.VirtualAddressSize,_ = strconv.ParseUint(fields[0], 10, 64)
+		}
+	}
 }
 
 // return new cpu obj
 func NewCpuOb() *CpuInfo {
 	CI := CpuInfo{}
-	cpuInfo,_ := exec.Command("sh", "-c", "cat /proc/cpuinfo").Output()
+	CI.sampler = &CpuSampler{}
+	CI.processSampler = &ProcessCpuSampler{}
+	// prime the samplers, so the first scrape already has a delta
+	if _,_,err := CI.sampler.Sample();err != nil {
+		logtax.Println(err.Error())
+	}
+	if _,err := CI.processSampler.Sample(context.Background());err != nil {
+		logtax.Println(err.Error())
+	}
+
+	CI.readTopology()
+	CI.readCpuInfo()
 
-	CI.PhysicalCpuNum = uint8(strings.Count(string(cpuInfo), "physical id"))
-	CI.SiblingsNum = uint8(strings.Count(string(cpuInfo), "siblings"))
-	CI.CoresNum = uint8(strings.Count(string(cpuInfo), "core id"))
-	CI.ModelName = string(regexp.MustCompile(`model name\s+:\s+(\w+)`).FindSubmatch(cpuInfo)[1])
-	CI.CpuCacheSize,_ = strconv.ParseUint(string(regexp.MustCompile(`cache size\s+:\s+(\d+)`).FindSubmatch(cpuInfo)[1]), 10, 64)
-	CI.VirtualAddressSize,_ = strconv.ParseUint(string(regexp.MustCompile(`address sizes\s+:\s+.+?(\d+)`).FindSubmatch(cpuInfo)[1]), 10, 64)
-	CI.SupportHT = CI.SiblingsNum == CI.CoresNum
+	CI.usageVec = getUsageCounterVec()
+	CI.coreUsageVec = getCoreUsageGaugeVec()
+	CI.physicalCpuNumVec = getPhysicalCpuNumGaugeVec()
+	CI.cpuInfoVec = getCpuInfoGaugeVec()
+	CI.loadAverageVec = getLoadAverageGaugeVec()
+	// buckets are scaled by the logical cpu num read above
+	CI.loadAverageHistogramVec = NewLoadAverageHistogramVec(CI.GetLoadAverageBucket())
+	CI.schedulerEntitiesVec = getSchedulerEntitiesGaugeVec()
+	CI.lastPidVec = getLastPidGaugeVec()
+	CI.processSeries = newProcessSeries()
 
 	CI.ExposePCNum()
+	CI.ExposeCpuInfo()
 
 	return &CI
-}
\ No newline at end of file
+}
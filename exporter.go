@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	logtax "log"
 	"net/http"
@@ -31,17 +30,22 @@ type GaugeVecMetrics struct {
 
 var (
 	LogDir = "/data/logs/"
-	gExporterConfig  = NewExporterConfig()
+	gExporterConfig  *GExporterConfig
 	commonProcessLabelNames = []string{"rank", "type"}
-	processGaugeVecMetrics = NewGaugeVecMetrics("process_workload_usage", "Cpu and mem usage of per process", commonProcessLabelNames)
+	processIdentityLabelNames = []string{"command", "pid"}
 	collectors = make([]prometheus.Collector, 0)
-	processGaugeVec = GetMetricsCollect()
-	straceMetricsVec = GetStraceMetricsGaugeVec()
-	usageGaugeVec = getUsageCounterVec()
-	loadAverageHistogramVec = NewLoadAverageHistogramVec()
+	sinkSendsCounterVec = getSinkSendsCounterVec()
+	sinkErrorsCounterVec = getSinkErrorsCounterVec()
+	collectorDurationGaugeVec = getCollectorDurationGaugeVec()
+	collectorSuccessGaugeVec = getCollectorSuccessGaugeVec()
+	collectorErrorsCounterVec = getCollectorErrorsCounterVec()
 )
 
 func init() {
+	// must register collector before expose/push, also when the log file
+	// cannot be opened
+	prometheus.MustRegister(collectors...)
+
 	// init log
 	// log.SetFormatter(new(GExporterLogFormatter))
 	// set logger output file
@@ -55,14 +59,6 @@ func init() {
 	// log.SetOutput(file)
 	logtax.SetOutput(file)
 	logtax.SetFlags(logtax.Ldate | logtax.Lshortfile | logtax.Ltime)
-
-	// must register collector before expose/push
-	prometheus.MustRegister(collectors...)
-
-	// start expose http server
-	if gExporterConfig.Configs["exporter"].(string) == "expose" {
-		go PromHttpServerStart()
-	}
 }
 
 func (f *GExporterLogFormatter) Format(entry *log.Entry) ([]byte, error) {
@@ -90,11 +86,49 @@ func (f *GExporterLogFormatter) Format(entry *log.Entry) ([]byte, error) {
 }
 
 func GetMetricsCollect() *prometheus.GaugeVec {
+	processGaugeVecMetrics := NewGaugeVecMetrics("process_workload_usage", "Cpu and mem usage of per process", processLabelNames())
 	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: processGaugeVecMetrics.Name,
 		Help: processGaugeVecMetrics.Help,
 	}, processGaugeVecMetrics.LabelsName)
-	collectors = append(collectors, vec)
+	return vec
+}
+
+// ranked process series, the cap bounds the series of process labels,
+// without them rank and type are already bounded by top_process_num
+func newProcessSeries() *SeriesTracker {
+	if !gExporterConfig.Configs["process_labels"].(bool) {
+		return NewSeriesTracker(GetMetricsCollect(), 0)
+	}
+	return NewSeriesTracker(GetMetricsCollect(), gExporterConfig.Configs["process_label_max_series"].(int))
+}
+
+// command and pid labels are opt-in, they make series per process
+func processLabelNames() []string {
+	if gExporterConfig.Configs["process_labels"].(bool) {
+		return append(append([]string{}, commonProcessLabelNames...), processIdentityLabelNames...)
+	}
+	return commonProcessLabelNames
+}
+
+// labels of a ranked process series
+func processLabels(indicator *Indicator, rank int, usageType string) prometheus.Labels {
+	labels := prometheus.Labels{
+		"rank": strconv.FormatInt(int64(rank), 10),
+		"type": usageType,
+	}
+	if gExporterConfig.Configs["process_labels"].(bool) {
+		labels["command"] = indicator.Name
+		labels["pid"] = strconv.FormatInt(int64(indicator.Pid), 10)
+	}
+	return labels
+}
+
+func getProcessGroupGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "process_group_usage",
+		Help: "Cpu and mem usage summed over a process group, and its process count",
+	}, []string{"group", "type"})
 	return vec
 }
 
@@ -103,7 +137,6 @@ func GetStraceMetricsGaugeVec() *prometheus.GaugeVec {
 		Name: "strace_metrics",
 		Help: "strace command return",
 	}, []string{"pid", "command", "call_name"})
-	collectors = append(collectors, vec)
 	return vec
 }
 
@@ -112,6 +145,90 @@ func getUsageCounterVec() *prometheus.GaugeVec {
 		Name: "workload_usage_gauge",
 		Help: "memory and cpu usage gauge",
 	}, []string{"type", "subtype"})
+	return vec
+}
+
+func getCoreUsageGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "core_workload_usage_gauge",
+		Help: "cpu usage gauge of per core",
+	}, []string{"cpu", "subtype"})
+	return vec
+}
+
+func getPhysicalCpuNumGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "physical_cpu_num",
+		Help: "physical cpu num",
+	}, []string{})
+	return vec
+}
+
+func getCpuInfoGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cpu_info",
+		Help: "cpu sockets, cores and threads num",
+	}, []string{"model_name", "cache_size", "type"})
+	return vec
+}
+
+func getMemInfoGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "system_memory_bytes",
+		Help: "/proc/meminfo fields in bytes",
+	}, []string{"field"})
+	return vec
+}
+
+func getMemRatioGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "system_memory_ratio",
+		Help: "used and available memory ratio derived from /proc/meminfo",
+	}, []string{"type"})
+	return vec
+}
+
+func getSinkSendsCounterVec() *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_sends_total",
+		Help: "snapshots sent to per sink",
+	}, []string{"sink"})
+	collectors = append(collectors, vec)
+	return vec
+}
+
+func getSinkErrorsCounterVec() *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_errors_total",
+		Help: "snapshots failed to send to per sink",
+	}, []string{"sink"})
+	collectors = append(collectors, vec)
+	return vec
+}
+
+func getCollectorDurationGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gexporter_collector_duration_seconds",
+		Help: "duration of the last update of per collector",
+	}, []string{"collector"})
+	collectors = append(collectors, vec)
+	return vec
+}
+
+func getCollectorSuccessGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gexporter_collector_success",
+		Help: "whether the last update of per collector succeeded",
+	}, []string{"collector"})
+	collectors = append(collectors, vec)
+	return vec
+}
+
+func getCollectorErrorsCounterVec() *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gexporter_collector_errors_total",
+		Help: "failed updates of per collector by reason",
+	}, []string{"collector", "reason"})
 	collectors = append(collectors, vec)
 	return vec
 }
@@ -126,13 +243,40 @@ func NewGaugeVecMetrics(metricsName string, MetricsHelp string, labelNames []str
 	}
 }
 
-func NewLoadAverageHistogramVec() *prometheus.HistogramVec {
+// load average histogram is an opt-in view of load_average_gauge
+func NewLoadAverageHistogramVec(buckets []float64) *prometheus.HistogramVec {
+	if !gExporterConfig.Configs["load_average_histogram"].(bool) {
+		return nil
+	}
 	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "load_average",
 		Help: "load average",
-		Buckets: CpuOb.GetLoadAverageBucket(),
+		Buckets: buckets,
 	}, []string{"range"})
-	collectors = append(collectors, vec)
+	return vec
+}
+
+func getLoadAverageGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "load_average_gauge",
+		Help: "load average of the last 1, 5 and 15 minutes",
+	}, []string{"range"})
+	return vec
+}
+
+func getSchedulerEntitiesGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "scheduler_entities",
+		Help: "runnable and total kernel scheduling entities",
+	}, []string{"state"})
+	return vec
+}
+
+func getLastPidGaugeVec() *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "last_pid",
+		Help: "pid most recently assigned by the kernel",
+	}, []string{})
 	return vec
 }
 
@@ -145,10 +289,19 @@ func GetGaugeVec(name string, help string, labels []string) *prometheus.GaugeVec
 	return gaugeVec
 }
 
+// default instance label, the hostname
+func defaultInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
 // a http server for exposing metrics
-func PromHttpServerStart() {
+func PromHttpServerStart(handler http.Handler) {
 	mux := http.NewServeMux()
-	mux.Handle(MetricsHttpPath, promhttp.Handler())
+	mux.Handle(MetricsHttpPath, handler)
 
 	httpServer := &http.Server{
 		Handler: mux,
@@ -0,0 +1,33 @@
+package exporter
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default config, flags of the test binary are left to the testing package
+func TestMain(m *testing.M) {
+	gExporterConfig = NewExporterConfig(flag.NewFlagSet("gexporter", flag.PanicOnError), nil)
+	os.Exit(m.Run())
+}
+
+// snapshot of a registry holding one gauge with a command and a pid label
+func testSnapshot(t *testing.T) *Snapshot {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "process_workload_usage",
+		Help: "test usage",
+	}, []string{"command", "pid", "type"})
+	registry.MustRegister(vec)
+	vec.WithLabelValues("nginx", "42", "cpu").Set(12.5)
+
+	snapshot, err := GatherSnapshot(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
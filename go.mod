@@ -3,6 +3,10 @@ module github.com/laokiea/exporter
 go 1.14
 
 require (
+	github.com/golang/snappy v0.0.1
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.10.0
 	github.com/sirupsen/logrus v1.4.2
+	google.golang.org/protobuf v1.23.0
 )
@@ -0,0 +1,218 @@
+// send metrics by graphite plaintext protocol
+
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	graphiteTimeout = time.Second * 5
+)
+
+var (
+	graphitePlaceholderRegex = regexp.MustCompile(`<([a-zA-Z_][a-zA-Z0-9_]*)>`)
+	graphiteValueEscaper     = strings.NewReplacer(".", "_", " ", "_", "/", "_", "\t", "_", "\n", "_")
+)
+
+// graphite sink writes `path value timestamp` lines over tcp, lines are
+// buffered while carbon is unreachable and the oldest are dropped when
+// the buffer is full, the connection is redialed on the next send
+type GraphiteSink struct {
+	address   string
+	host      string
+	template  string
+	templates map[string]string
+	maxBuffer int
+	mtx       sync.Mutex
+	conn      net.Conn
+	buffer    []string
+	dropped   int
+}
+
+// parse per metric templates like "process_workload_usage=gexporter.<host>.process.<command>.<type>;..."
+func ParseGraphiteTemplates(templates string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, template := range strings.Split(templates, ";") {
+		if strings.TrimSpace(template) == "" {
+			continue
+		}
+		kv := strings.SplitN(template, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, errors.New("graphite template must be metric=template: " + template)
+		}
+		parsed[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return parsed, nil
+}
+
+// template is the path of metrics without their own template in templates,
+// maxBuffer is the max lines kept while carbon is down
+func NewGraphiteSink(address string, host string, template string, templates map[string]string, maxBuffer int) *GraphiteSink {
+	return &GraphiteSink{
+		address:   address,
+		host:      host,
+		template:  template,
+		templates: templates,
+		maxBuffer: maxBuffer,
+		buffer:    make([]string, 0),
+	}
+}
+
+func (sink *GraphiteSink) Name() string {
+	return "graphite"
+}
+
+// buffer the lines of a snapshot and write all buffered lines
+func (sink *GraphiteSink) Send(snapshot *Snapshot) error {
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+
+	sink.buffer = append(sink.buffer, sink.lines(snapshot)...)
+	if overflow := len(sink.buffer) - sink.maxBuffer; overflow > 0 {
+		sink.buffer = sink.buffer[overflow:]
+		sink.dropped += overflow
+	}
+
+	if err := sink.flush(); err != nil {
+		return err
+	}
+	if sink.dropped > 0 {
+		err := fmt.Errorf("graphite buffer full, %d lines dropped", sink.dropped)
+		sink.dropped = 0
+		return err
+	}
+
+	return nil
+}
+
+// try once more to write the buffered lines
+func (sink *GraphiteSink) Close() error {
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+
+	err := sink.flush()
+	if sink.conn != nil {
+		_ = sink.conn.Close()
+		sink.conn = nil
+	}
+
+	return err
+}
+
+// write buffered lines, the connection is dropped on error and the
+// lines are kept, so lines may be written twice after a partial write
+func (sink *GraphiteSink) flush() error {
+	if len(sink.buffer) == 0 {
+		return nil
+	}
+
+	if sink.conn == nil {
+		conn, err := net.DialTimeout("tcp", sink.address, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+
+	var payload bytes.Buffer
+	for _, line := range sink.buffer {
+		payload.WriteString(line)
+	}
+	_ = sink.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := sink.conn.Write(payload.Bytes()); err != nil {
+		_ = sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	sink.buffer = sink.buffer[:0]
+
+	return nil
+}
+
+// one line per value, histograms and summaries are sent as sum and count
+func (sink *GraphiteSink) lines(snapshot *Snapshot) []string {
+	lines := make([]string, 0)
+	timestamp := strconv.FormatInt(snapshot.Time.Unix(), 10)
+	for _, family := range snapshot.Families {
+		template, ok := sink.templates[family.GetName()]
+		if !ok {
+			template = sink.template
+		}
+
+		for _, metric := range family.GetMetric() {
+			values := make(map[string]float64)
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				values[""] = metric.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				values[""] = metric.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				values[""] = metric.GetUntyped().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				values[".sum"] = metric.GetHistogram().GetSampleSum()
+				values[".count"] = float64(metric.GetHistogram().GetSampleCount())
+			case dto.MetricType_SUMMARY:
+				values[".sum"] = metric.GetSummary().GetSampleSum()
+				values[".count"] = float64(metric.GetSummary().GetSampleCount())
+			}
+
+			path := graphitePath(template, family.GetName(), sink.host, metric.GetLabel())
+			for suffix, value := range values {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					continue
+				}
+				lines = append(lines, path+suffix+" "+strconv.FormatFloat(value, 'f', -1, 64)+" "+timestamp+"\n")
+			}
+		}
+	}
+
+	return lines
+}
+
+// expand a template, <name> is the metric name, <host> the host, <labels>
+// the values of labels not used elsewhere in the template, any other
+// placeholder the label value, empty path nodes are removed
+func graphitePath(template string, name string, host string, labels []*dto.LabelPair) string {
+	values := make(map[string]string)
+	for _, pair := range labels {
+		values[pair.GetName()] = graphiteValueEscaper.Replace(pair.GetValue())
+	}
+	values["name"] = name
+	values["host"] = graphiteValueEscaper.Replace(host)
+
+	used := make(map[string]bool)
+	for _, match := range graphitePlaceholderRegex.FindAllStringSubmatch(template, -1) {
+		used[match[1]] = true
+	}
+	rest := make([]string, 0)
+	for _, pair := range labels {
+		if !used[pair.GetName()] && pair.GetValue() != "" {
+			rest = append(rest, graphiteValueEscaper.Replace(pair.GetValue()))
+		}
+	}
+	values["labels"] = strings.Join(rest, ".")
+
+	nodes := make([]string, 0)
+	for _, node := range strings.Split(template, ".") {
+		node = graphitePlaceholderRegex.ReplaceAllStringFunc(node, func(placeholder string) string {
+			return values[placeholder[1:len(placeholder)-1]]
+		})
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return strings.Join(nodes, ".")
+}
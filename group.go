@@ -0,0 +1,148 @@
+// group processes and aggregate their usage
+
+package exporter
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	logtax "log"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	otherProcessGroup = "other"
+)
+
+// a named regex rule, the name may refer to submatches like $1 or ${name}
+type ProcessGroupRule struct {
+	Name  string
+	Regex *regexp.Regexp
+}
+
+// process grouper groups indicators by command name, user or rules
+type ProcessGrouper struct {
+	by     string
+	rules  []*ProcessGroupRule
+	mtx    sync.Mutex
+	users  map[uint32]string // user name cache
+	series *SeriesTracker
+}
+
+// usage summed over a group
+type processGroupUsage struct {
+	UssMemUsage float64
+	PssMemUsage float64
+	RssMemUsage float64
+	SwapUsage   float64
+	CpuUsage    float64
+	Count       float64
+}
+
+// parse rules like "web=^nginx;php=^php-fpm;java-$1=^java-(\w+)",
+// processes are matched by command base name, first matching rule wins
+func ParseProcessGroupRules(rules string) ([]*ProcessGroupRule, error) {
+	groupRules := make([]*ProcessGroupRule, 0)
+	for _, rule := range strings.Split(rules, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		kv := strings.SplitN(rule, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.New("process group rule must be name=regex: " + rule)
+		}
+		regex, err := regexp.Compile(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		groupRules = append(groupRules, &ProcessGroupRule{Name: strings.TrimSpace(kv[0]), Regex: regex})
+	}
+
+	return groupRules, nil
+}
+
+func NewProcessGrouper(by string, rules []*ProcessGroupRule) *ProcessGrouper {
+	return &ProcessGrouper{
+		by:     by,
+		rules:  rules,
+		users:  make(map[uint32]string),
+		series: NewSeriesTracker(getProcessGroupGaugeVec(), 0),
+	}
+}
+
+// group name of an indicator
+func (grouper *ProcessGrouper) Group(indicator *Indicator) string {
+	switch grouper.by {
+	case "name":
+		return indicator.Name
+	case "user":
+		return grouper.userName(indicator.Pid)
+	case "rule":
+		for _, rule := range grouper.rules {
+			if match := rule.Regex.FindStringSubmatchIndex(indicator.Name); match != nil {
+				return string(rule.Regex.ExpandString(nil, rule.Name, indicator.Name, match))
+			}
+		}
+	}
+	return otherProcessGroup
+}
+
+// user name of a process owner, uid if the user is unknown
+func (grouper *ProcessGrouper) userName(pid int32) string {
+	uid, err := ReadProcessUid(pid)
+	if err != nil {
+		return otherProcessGroup
+	}
+
+	grouper.mtx.Lock()
+	defer grouper.mtx.Unlock()
+	if name, ok := grouper.users[uid]; ok {
+		return name
+	}
+
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	} else {
+		logtax.Println(err.Error())
+	}
+	grouper.users[uid] = name
+
+	return name
+}
+
+// expose summed usage of every group
+func (grouper *ProcessGrouper) Expose(indicators []*Indicator) {
+	if grouper.by == "none" {
+		return
+	}
+
+	groups := make(map[string]*processGroupUsage)
+	for _, indicator := range indicators {
+		name := grouper.Group(indicator)
+		usage, ok := groups[name]
+		if !ok {
+			usage = &processGroupUsage{}
+			groups[name] = usage
+		}
+		usage.UssMemUsage += indicator.UssMemUsage
+		usage.PssMemUsage += indicator.PssMemUsage
+		usage.RssMemUsage += indicator.RssMemUsage
+		usage.SwapUsage += indicator.SwapUsage
+		usage.CpuUsage += indicator.CpuUsage
+		usage.Count++
+	}
+
+	for name, usage := range groups {
+		grouper.series.Set(prometheus.Labels{"group": name, "type": "uss"}, usage.UssMemUsage)
+		grouper.series.Set(prometheus.Labels{"group": name, "type": "pss"}, usage.PssMemUsage)
+		grouper.series.Set(prometheus.Labels{"group": name, "type": "rss"}, usage.RssMemUsage)
+		grouper.series.Set(prometheus.Labels{"group": name, "type": "swap"}, usage.SwapUsage)
+		grouper.series.Set(prometheus.Labels{"group": name, "type": "cpu"}, usage.CpuUsage)
+		grouper.series.Set(prometheus.Labels{"group": name, "type": "count"}, usage.Count)
+	}
+	grouper.series.Flush()
+}
@@ -0,0 +1,222 @@
+// send metrics by influxdb line protocol
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	influxTimeout = time.Second * 10
+	// keep udp packets within what influxdb reads by default
+	influxUdpMaxPayload = 64000
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influx sink writes snapshots as line protocol, over http to the
+// /write or /api/v2/write endpoint, or over udp for udp:// urls
+type InfluxSink struct {
+	url       string
+	udp       bool
+	host      string
+	batchSize int
+	client    *http.Client
+	conn      net.Conn
+}
+
+// batchSize is the max lines of a request or packet
+func NewInfluxSink(rawUrl string, host string, batchSize int) (*InfluxSink, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &InfluxSink{
+		url:       rawUrl,
+		host:      host,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: influxTimeout},
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "udp":
+		sink.udp = true
+		if sink.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupport influx url scheme %q", u.Scheme)
+	}
+
+	return sink, nil
+}
+
+func (sink *InfluxSink) Name() string {
+	return "influx"
+}
+
+// write a snapshot in batches
+func (sink *InfluxSink) Send(snapshot *Snapshot) error {
+	var (
+		batch bytes.Buffer
+		lines int
+	)
+	for _, line := range influxLines(snapshot, sink.host) {
+		if lines > 0 && (lines >= sink.batchSize || (sink.udp && batch.Len()+len(line) > influxUdpMaxPayload)) {
+			if err := sink.write(batch.Bytes()); err != nil {
+				return err
+			}
+			batch.Reset()
+			lines = 0
+		}
+		batch.WriteString(line)
+		lines++
+	}
+	if lines > 0 {
+		return sink.write(batch.Bytes())
+	}
+
+	return nil
+}
+
+func (sink *InfluxSink) Close() error {
+	if sink.conn != nil {
+		return sink.conn.Close()
+	}
+	return nil
+}
+
+func (sink *InfluxSink) write(body []byte) error {
+	if sink.udp {
+		_, err := sink.conn.Write(body)
+		return err
+	}
+
+	resp, err := sink.client.Post(sink.url, "text/plain; charset=utf-8", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("influx server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	return nil
+}
+
+// one line per metric, measurement is the family name, labels and host
+// are tags, histograms and summaries become several fields of one line
+func influxLines(snapshot *Snapshot, host string) []string {
+	lines := make([]string, 0)
+	for _, family := range snapshot.Families {
+		for _, metric := range family.GetMetric() {
+			timestamp := snapshot.Time.UnixNano()
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs() * int64(time.Millisecond)
+			}
+
+			fields := make(map[string]float64)
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				fields["value"] = metric.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				fields["value"] = metric.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				fields["value"] = metric.GetUntyped().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					fields["le_"+formatFloat(bucket.GetUpperBound())] = float64(bucket.GetCumulativeCount())
+				}
+				fields["sum"] = histogram.GetSampleSum()
+				fields["count"] = float64(histogram.GetSampleCount())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					fields["q_"+formatFloat(quantile.GetQuantile())] = quantile.GetValue()
+				}
+				fields["sum"] = summary.GetSampleSum()
+				fields["count"] = float64(summary.GetSampleCount())
+			}
+			if line := influxLine(family.GetName(), influxTags(metric.GetLabel(), host), fields, timestamp); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	return lines
+}
+
+// labels and host as tags, influx does not allow empty tag values
+func influxTags(labels []*dto.LabelPair, host string) map[string]string {
+	tags := make(map[string]string)
+	if host != "" {
+		tags["host"] = host
+	}
+	for _, pair := range labels {
+		if pair.GetValue() != "" {
+			tags[pair.GetName()] = pair.GetValue()
+		}
+	}
+	return tags
+}
+
+// measurement,tag=v,... field=v,... timestamp, tags and fields sorted
+func influxLine(measurement string, tags map[string]string, fields map[string]float64, timestamp int64) string {
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, k := range sortedKeys(tags) {
+		line.WriteString("," + influxKeyEscaper.Replace(k) + "=" + influxKeyEscaper.Replace(tags[k]))
+	}
+
+	separator := " "
+	written := 0
+	fieldKeys := make([]string, 0, len(fields))
+	for k := range fields {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+	for _, k := range fieldKeys {
+		// NaN and Inf are not representable
+		if math.IsNaN(fields[k]) || math.IsInf(fields[k], 0) {
+			continue
+		}
+		line.WriteString(separator + influxKeyEscaper.Replace(k) + "=" + strconv.FormatFloat(fields[k], 'g', -1, 64))
+		separator = ","
+		written++
+	}
+	if written == 0 {
+		return ""
+	}
+	line.WriteString(" " + strconv.FormatInt(timestamp, 10) + "\n")
+
+	return line.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
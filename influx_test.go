@@ -0,0 +1,162 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxLine(t *testing.T) {
+	cases := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		fields      map[string]float64
+		want        string
+	}{
+		{
+			name:        "plain",
+			measurement: "load_average",
+			tags:        map[string]string{"host": "h1", "range": "1"},
+			fields:      map[string]float64{"value": 0.5},
+			want:        "load_average,host=h1,range=1 value=0.5 1000\n",
+		},
+		{
+			name:        "escaped measurement",
+			measurement: "cpu usage,total",
+			tags:        map[string]string{},
+			fields:      map[string]float64{"value": 1},
+			want:        `cpu\ usage\,total value=1 1000` + "\n",
+		},
+		{
+			name:        "escaped tags",
+			measurement: "process_workload_usage",
+			tags:        map[string]string{"command": "java -jar a=b,c"},
+			fields:      map[string]float64{"value": 2},
+			want:        `process_workload_usage,command=java\ -jar\ a\=b\,c value=2 1000` + "\n",
+		},
+		{
+			name:        "escaped field keys",
+			measurement: "m",
+			tags:        map[string]string{},
+			fields:      map[string]float64{"le 1,0": 3, "count": 4},
+			want:        `m count=4,le\ 1\,0=3 1000` + "\n",
+		},
+		{
+			name:        "non finite fields dropped",
+			measurement: "m",
+			tags:        map[string]string{},
+			fields:      map[string]float64{"value": math.NaN(), "sum": math.Inf(1), "count": 1},
+			want:        "m count=1 1000\n",
+		},
+		{
+			name:        "no finite field",
+			measurement: "m",
+			tags:        map[string]string{},
+			fields:      map[string]float64{"value": math.NaN()},
+			want:        "",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := influxLine(c.measurement, c.tags, c.fields, 1000); got != c.want {
+				t.Errorf("influxLine() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestInfluxLines(t *testing.T) {
+	snapshot := testSnapshot(t)
+	snapshot.Time = time.Unix(1, 0)
+
+	lines := influxLines(snapshot, "h1")
+	want := "process_workload_usage,command=nginx,host=h1,pid=42,type=cpu value=12.5 1000000000\n"
+	if len(lines) != 1 || lines[0] != want {
+		t.Errorf("influxLines() = %q, want %q", lines, want)
+	}
+}
+
+func TestInfluxSinkHttp(t *testing.T) {
+	var (
+		contentType string
+		body        string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		content, _ := ioutil.ReadAll(r.Body)
+		body = string(content)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=gexporter", "h1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send(testSnapshot(t)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("content type = %q, want text/plain", contentType)
+	}
+	if !strings.HasPrefix(body, "process_workload_usage,command=nginx,host=h1,pid=42,type=cpu value=12.5 ") {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestInfluxSinkHttpError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/write?db=missing", "h1", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	err = sink.Send(testSnapshot(t))
+	if err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Errorf("Send() error = %v, want the server message", err)
+	}
+}
+
+func TestInfluxSinkUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewInfluxSink("udp://"+conn.LocalAddr().String(), "h1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	snapshot := testSnapshot(t)
+	snapshot.Families = append(snapshot.Families, snapshot.Families...)
+	if err := sink.Send(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// batch size 1, one line per packet
+	buf := make([]byte, influxUdpMaxPayload)
+	for i := 0; i < 2; i++ {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if packet := string(buf[:n]); strings.Count(packet, "\n") != 1 || !strings.HasPrefix(packet, "process_workload_usage,") {
+			t.Errorf("packet %d = %q, want a single line", i, packet)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package exporter
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,8 +13,10 @@ import (
 	"os/exec"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -23,13 +25,20 @@ const (
 	SmemCommandNotInstalledErr = "smem command not installed"
 )
 
+var (
+	NoMemoryBackendAvailableErr = errors.New("no memory backend available")
+)
+
 // Normal indicator include cpu/mem usage
 type Indicator struct {
 	UssMemUsage 	float64  `json:"uss_mem_usage"`
 	PssMemUsage 	float64  `json:"pss_mem_usage"`
 	RssMemUsage 	float64  `json:"rss_mem_usage"`
+	SwapUsage       float64  `json:"swap_usage"`
+	CpuUsage        float64  `json:"cpu_usage"`
 	Pid             int32    `json:"pid"`
 	Command         string   `json:"command"`
+	Name            string   `json:"-"`
 }
 
 // memory info struct
@@ -38,6 +47,18 @@ type MemoryInfo struct {
 	UssMemUsage                float64
 	PssMemUsage                float64
 	MemIndicators     	   []*Indicator
+	backends                   []MemoryBackend
+	grouper                    *ProcessGrouper
+	straceQueue                []*Indicator // high usage processes waiting for strace
+	straceQueueMtx             sync.Mutex
+	// vecs of the meminfo collector
+	memInfoVec                 *prometheus.GaugeVec
+	memRatioVec                *prometheus.GaugeVec
+	// vecs of the memory collector, group usage is owned by the grouper
+	usageVec                   *prometheus.GaugeVec
+	processSeries              *SeriesTracker
+	// vec of the strace collector
+	straceVec                  *prometheus.GaugeVec
 }
 
 // Strace metrics
@@ -51,53 +72,122 @@ type StraceMetrics struct {
 func NewMemoryOb() *MemoryInfo {
 	MI := MemoryInfo{}
 	MI.MemIndicators = make([]*Indicator, 0)
+	MI.backends = NewMemoryBackends(gExporterConfig.Configs["memory_backend"].(string))
+	MI.grouper = NewProcessGrouper(gExporterConfig.Configs["process_group_by"].(string), gExporterConfig.Configs["process_group_rules"].([]*ProcessGroupRule))
+	MI.memInfoVec = getMemInfoGaugeVec()
+	MI.memRatioVec = getMemRatioGaugeVec()
+	MI.usageVec = getUsageCounterVec()
+	MI.processSeries = newProcessSeries()
+	MI.straceVec = GetStraceMetricsGaugeVec()
 
 	return &MI
 }
 
-func (memory *MemoryInfo) ExposeUssMemoryUsage() {
-	defer timeUseCondition()
-	memory.GetMemoryIndicators()
+func (memory *MemoryInfo) ExposeUssMemoryUsage(ctx context.Context) error {
+	if err := memory.GetMemoryIndicators(ctx);err != nil {
+		return err
+	}
 	// total memory usage
 	memory.exposePssTotalMemUsage()
-	// top10 memory usage
-	exporter := gExporterConfig.Configs["exporter"].(string)
-	for rank,indicator := range memory.MemIndicators[:10] {
-		switch exporter {
-		case "pushgateway":
-			//NormalUsagePushGateway(indicator)
-		case "expose":
-			memory.exposeNormalUssUsage(indicator, strconv.FormatInt(int64(rank), 10))
-		}
+	// process group usage, summed over all processes
+	memory.grouper.Expose(memory.MemIndicators)
+	// top n memory usage
+	rankBy := gExporterConfig.Configs["rank_by"].(string)
+	for rank,indicator := range topIndicators(memory.MemIndicators, rankBy) {
+		memory.exposeRankedUsage(indicator, rank, rankBy)
 	}
+	memory.processSeries.Flush()
 	// reset
 	memory.resetMemoryUsage()
+
+	return nil
+}
+
+// value of an indicator by ranking key
+func (indicator *Indicator) RankValue(key string) float64 {
+	switch key {
+	case "uss":
+		return indicator.UssMemUsage
+	case "pss":
+		return indicator.PssMemUsage
+	case "rss":
+		return indicator.RssMemUsage
+	case "swap":
+		return indicator.SwapUsage
+	case "cpu":
+		return indicator.CpuUsage
+	}
+	return 0
+}
+
+// top n indicators sorted desc by ranking key, fewer if not enough
+// n is bounded by max_process_num, indicators are not truncated before
+func topIndicators(indicators []*Indicator, key string) []*Indicator {
+	sorted := make([]*Indicator, len(indicators))
+	copy(sorted, indicators)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].RankValue(key) > sorted[j].RankValue(key)
+	})
+
+	if topN := gExporterConfig.Configs["top_process_num"].(int);len(sorted) > topN {
+		sorted = sorted[:topN]
+	}
+	return sorted
 }
 
 // fix command name
-//
+// Name keeps the base name, Command becomes "name,pid"
 func (memory *MemoryInfo) fixCommandName(indicator *Indicator) {
-	name := indicator.Command
+	name := strings.TrimSpace(indicator.Command)
 	if strings.Contains(name, string(os.PathSeparator)) {
 		lastSlashPos := strings.LastIndex(name, string(os.PathSeparator))
-		indicator.Command = name[lastSlashPos+1:]
+		name = name[lastSlashPos+1:]
 	}
-	indicator.Command = fmt.Sprintf("%s,%d", indicator.Command, indicator.Pid)
+	indicator.Name = name
+	indicator.Command = fmt.Sprintf("%s,%d", name, indicator.Pid)
 }
 
-// uss memory usage expose
-func (memory *MemoryInfo) exposeNormalUssUsage(indicator *Indicator, rank string) {
-	processGaugeVec.With(prometheus.Labels{
-		//"command" : indicator.Command,
-		"rank": rank,
-		//"pid" : strconv.FormatInt(int64(indicator.Pid), 10),
-		"type" : "mem",
-	}).Set(indicator.UssMemUsage)
+// expose uss as type mem like before ranking was configurable, the
+// ranking value is added as type rank_ and the key when not the default
+func (memory *MemoryInfo) exposeRankedUsage(indicator *Indicator, rank int, key string) {
+	memory.processSeries.Set(processLabels(indicator, rank, "mem"), indicator.UssMemUsage)
+	if key != DefaultRankBy {
+		memory.processSeries.Set(processLabels(indicator, rank, "rank_" + key), indicator.RankValue(key))
+	}
 }
 
 // expose total memory usage
 func (memory *MemoryInfo) exposePssTotalMemUsage() {
-	usageGaugeVec.With(prometheus.Labels{"type": "mem", "subtype": "mem"}).Set(memory.PssMemUsage)
+	memory.usageVec.With(prometheus.Labels{"type": "mem", "subtype": "mem"}).Set(memory.PssMemUsage)
+}
+
+// expose every /proc/meminfo field and used/available ratios
+func (memory *MemoryInfo) ExposeSystemMemInfo() error {
+	memInfo, err := ReadMemInfo()
+	if err != nil {
+		return err
+	}
+
+	for field,value := range memInfo {
+		memory.memInfoVec.WithLabelValues(field).Set(float64(value))
+	}
+
+	memTotal := float64(memInfo["MemTotal"])
+	if memTotal == 0 {
+		return nil
+	}
+	available, ok := memInfo["MemAvailable"]
+	if !ok {
+		// kernels before 3.14 have no MemAvailable
+		available = memInfo["MemFree"] + memInfo["Buffers"] + memInfo["Cached"]
+	}
+	memory.memRatioVec.WithLabelValues("available").Set(float64(available) / memTotal)
+	memory.memRatioVec.WithLabelValues("used").Set(1 - float64(available) / memTotal)
+	if swapTotal := float64(memInfo["SwapTotal"]);swapTotal > 0 {
+		memory.memRatioVec.WithLabelValues("swap_used").Set(1 - float64(memInfo["SwapFree"]) / swapTotal)
+	}
+
+	return nil
 }
 
 // reset memory info obj memory usage
@@ -116,61 +206,81 @@ func (memory *MemoryInfo) CalPssMemoryUsage() {
 	}
 }
 
-// get uss memory usage indicators
-func (memory *MemoryInfo) GetMemoryIndicators() {
-	if !memory.checkSmemCommandInstalled() {
-		//log.WithFields(log.Fields{"skip":7}).Fatal(errors.New(SmemCommandNotInstalledErr))
-		logtax.Fatal(errors.New(SmemCommandNotInstalledErr))
+// get uss memory usage indicators of all processes
+// backends are tried in order, unavailable or failing ones are skipped
+func (memory *MemoryInfo) GetMemoryIndicators(ctx context.Context) error {
+	var (
+		indicators []*Indicator
+		err        error
+	)
+	for _,backend := range memory.backends {
+		if !backend.Available() {
+			continue
+		}
+		if indicators, err = backend.Indicators(ctx);err == nil {
+			break
+		}
+		// do not fall back to other backends after the deadline
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logtax.Println(fmt.Sprintf("memory backend %s: %s", backend.Name(), err.Error()))
 	}
-
-	cmd := `smem -s pss -rHp -c "pid uss pss command" | head -n %d | awk '{if(NR > 0) print "{\"uss_mem_usage\":" $2 ",\"pss_mem_usage\":" $3 ",\"command\":\""} {for (i=4;i<=NF;i++)printf("%s ", $i);}  {print "\",\"pid\":" $1 "}"}'`
-	result,err := exec.Command("sh", "-c", fmt.Sprintf(cmd, gExporterConfig.Configs["max_process_num"].(int), "%s")).Output()
-	if err != nil {
-		//log.WithFields(log.Fields{"skip":7}).Fatal(err.Error())
-		logtax.Fatal(err.Error())
+	if indicators == nil {
+		return NoMemoryBackendAvailableErr
 	}
 
-	metricsString := strings.Trim(string(result), "\n")
-	// trim \n
-	metricsString = strings.ReplaceAll(metricsString, "%", "")
-	metricsString = strings.ReplaceAll(metricsString, "\"command\":\"\n", "\"command\":\"")
-	metricsSlice := strings.Split(metricsString, "\n")
-
 	memory.MemIndicators = memory.MemIndicators[:0]
-	for _,metric := range metricsSlice {
-		var rssIndicator = Indicator{}
-		metric = strings.ReplaceAll(metric, "\n", " ")
-		if err := json.Unmarshal([]byte(metric), &rssIndicator);err != nil {
-			// log.WithFields(log.Fields{"skip":7}).Error(err.Error())
-			// logtax.Println(err.Error())
-			continue
-		}
-
-		memory.fixCommandName(&rssIndicator)
-		if rssIndicator.Command == excludeSelfProcess {
+	for _,indicator := range indicators {
+		indicator.CpuUsage = CpuOb.processSampler.Usage(indicator.Pid)
+		memory.fixCommandName(indicator)
+		if indicator.Name == excludeSelfProcess {
 			continue
 		}
 
-		go memory.HighUsageCheck(&rssIndicator)
-		memory.MemIndicators = append(memory.MemIndicators, &rssIndicator)
+		memory.HighUsageCheck(indicator)
+		memory.MemIndicators = append(memory.MemIndicators, indicator)
 	}
 
 	memory.CalPssMemoryUsage()
+
+	return nil
 }
 
 // high usage check
 // use Uss
 func (memory *MemoryInfo) HighUsageCheck(indicator *Indicator) {
 	if indicator.UssMemUsage >= HighUsageMemThreshold {
-		memory.CollectStraceMetrics(indicator)
+		memory.queueStrace(indicator)
 	}
 }
 
+// queue a process for the strace collector, nothing is queued if it is disabled
+func (memory *MemoryInfo) queueStrace(indicator *Indicator) {
+	if !collectorEnabled("strace") {
+		return
+	}
+	memory.straceQueueMtx.Lock()
+	memory.straceQueue = append(memory.straceQueue, indicator)
+	memory.straceQueueMtx.Unlock()
+}
+
+// take all queued processes
+func (memory *MemoryInfo) dequeueStrace() []*Indicator {
+	memory.straceQueueMtx.Lock()
+	defer memory.straceQueueMtx.Unlock()
+	queue := memory.straceQueue
+	memory.straceQueue = nil
+	return queue
+}
+
 // strace process system call detail
-func (memory *MemoryInfo) CollectStraceMetrics(indicator *Indicator) {
+// strace is interrupted after StraceAttachTime, and killed if it hangs after that
+// ctx is done on shutdown, strace is killed then
+func (memory *MemoryInfo) CollectStraceMetrics(ctx context.Context, indicator *Indicator) {
 	if runtime.GOOS != TargetOs || os.Getuid() != 0 {
 		//log.WithFields(log.Fields{"skip":7}).Fatal(errors.New("strace must run as root within linux os"))
-		logtax.Fatal(errors.New("strace must run as root within linux os"))
+		logtax.Println(errors.New("strace must run as root within linux os"))
 		return
 	}
 
@@ -183,22 +293,27 @@ func (memory *MemoryInfo) CollectStraceMetrics(indicator *Indicator) {
 		straceBuffer    = &bytes.Buffer{}
 	)
 
+	stracePidsMtx.Lock()
 	if stracePids[indicator.Pid] == true {
+		stracePidsMtx.Unlock()
 		return
 	} else {
 		stracePids[indicator.Pid] = true
 	}
+	stracePidsMtx.Unlock()
 
 	defer straceFile.Close()
 
-	highUsageCCmd := fmt.Sprintf("strace -u work -f -p %d -c -e trace=all -o %s", indicator.Pid, straceFileName)
-	execCmd := exec.Command("sh", "-c", highUsageCCmd)
+	ctx, cancel := context.WithTimeout(ctx, time.Second * time.Duration(StraceAttachTime + straceKillGrace))
+	defer cancel()
+	execCmd := exec.CommandContext(ctx, "strace", "-u", "work", "-f", "-p", strconv.FormatInt(int64(indicator.Pid), 10), "-c", "-e", "trace=all", "-o", straceFileName)
 	execCmd.Stdout = straceBuffer
 
 
 	if err := execCmd.Start();err != nil {
 		//log.WithFields(log.Fields{"skip":7}).Fatal(err.Error()+",Command start failed")
-		logtax.Fatal(err.Error()+",Command start failed")
+		logtax.Println(err.Error()+",Command start failed")
+		return
 	}
 
 	go func(pid int) {
@@ -212,6 +327,8 @@ func (memory *MemoryInfo) CollectStraceMetrics(indicator *Indicator) {
 				logtax.Println(err.Error() + ",send SIGINT error")
 			}
 			return
+		case <-ctx.Done():
+			return
 		}
 	}(execCmd.Process.Pid)
 
@@ -243,10 +360,7 @@ func (memory *MemoryInfo) CollectStraceMetrics(indicator *Indicator) {
 					metricsS.Syscall = metricsSlice[4]
 				}
 
-				switch gExporterConfig.Configs["exporter"].(string) {
-				case "expose":
-					memory.exposeHighUsageStraceMetrics(&metricsS)
-				}
+				memory.exposeHighUsageStraceMetrics(&metricsS)
 			}
 			lineIndex++
 		}
@@ -255,56 +369,9 @@ func (memory *MemoryInfo) CollectStraceMetrics(indicator *Indicator) {
 
 // expose metrics
 func (memory *MemoryInfo) exposeHighUsageStraceMetrics(metric *StraceMetrics) {
-	straceMetricsVec.With(prometheus.Labels{
+	memory.straceVec.With(prometheus.Labels{
 		"pid" : strconv.FormatInt(int64(metric.I.Pid), 10),
 		"command" : metric.I.Command,
 		"call_name" : metric.Syscall,
 	}).Set(metric.Calls)
 }
-
-// check smem command installed
-func (memory *MemoryInfo) checkSmemCommandInstalled() bool {
-	wi,_ := exec.Command(`whereis smem`).Output()
-	if string(wi) == " " {
-		return false
-	}
-	return true
-}
-
-// get rss memory usage
-// do not use this function instead of using GetUssMemoryUsage
-func (memory *MemoryInfo) GetRssMemoryUsage() {
-	var (
-		maxProcessNum = gExporterConfig.Configs["max_process_num"].(int)
-		cmdFormat = `ps aux | sort -r -n -k 4 | head -n %d | awk '{if(NR > 0) print "{\"rss_mem_usage\":" $4 ",\"pid\":" $2 ",\"command\":\""} {if(NR > 0) for (i=11;i<=NF;i++)printf("%s ", $i);}  {if(NR > 0) print "\"}"}'`
-		metricsCmd = fmt.Sprintf(cmdFormat, maxProcessNum + 1, "%s")
-	)
-
-	cmd := exec.Command("sh", "-c", metricsCmd)
-	result, err := cmd.Output()
-	if err != nil {
-		//log.WithFields(log.Fields{"skip":7}).Fatal(err.Error())
-		logtax.Fatal(err.Error())
-	}
-
-	metricsString := strings.Trim(string(result), "\n")
-	// trim \n
-	metricsString = strings.ReplaceAll(metricsString, "\"command\":\"\n", "\"command\":\"")
-	metricsSlice := strings.Split(metricsString, "\n")
-
-	for _,metric := range metricsSlice {
-		var indicator = Indicator{}
-		metric = strings.ReplaceAll(metric, "\n", " ")
-		if err := json.Unmarshal([]byte(metric), &indicator);err != nil {
-			// log.WithFields(log.Fields{"skip":7}).Error(err.Error())
-			logtax.Println(err.Error())
-			continue
-		}
-
-		memory.fixCommandName(&indicator)
-		if indicator.Command == excludeSelfProcess {
-			continue
-		}
-		memory.RssMemUsage += indicator.RssMemUsage
-	}
-}
\ No newline at end of file
@@ -0,0 +1,225 @@
+// per process memory backends
+
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+var (
+	memoryBackendNames = []string{"procfs", "smem", "ps"}
+)
+
+// memory backend returns memory usage indicators of all processes
+// usages are percent of total memory, sorted desc
+type MemoryBackend interface {
+	Name() string
+	Available() bool
+	Indicators(ctx context.Context) ([]*Indicator, error)
+}
+
+// native backend reading /proc/[pid]/smaps_rollup
+type procfsMemoryBackend struct{}
+
+// backend running smem
+type smemMemoryBackend struct{}
+
+// backend running ps aux, only rss is known
+type psMemoryBackend struct{}
+
+// return backends in the order to try, the chosen one first
+// and the others as fallback, "auto" keeps the default order
+func NewMemoryBackends(chosen string) []MemoryBackend {
+	backends := make([]MemoryBackend, 0, len(memoryBackendNames))
+	for _, name := range append([]string{chosen}, memoryBackendNames...) {
+		var backend MemoryBackend
+		switch name {
+		case "procfs":
+			backend = &procfsMemoryBackend{}
+		case "smem":
+			backend = &smemMemoryBackend{}
+		case "ps":
+			backend = &psMemoryBackend{}
+		default:
+			continue
+		}
+
+		duplicated := false
+		for _, b := range backends {
+			if b.Name() == backend.Name() {
+				duplicated = true
+			}
+		}
+		if !duplicated {
+			backends = append(backends, backend)
+		}
+	}
+
+	return backends
+}
+
+func (backend *procfsMemoryBackend) Name() string {
+	return "procfs"
+}
+
+// smaps_rollup or smaps of other users' processes needs root, so probe
+// init instead of the exporter itself
+func (backend *procfsMemoryBackend) Available() bool {
+	_, err := ReadProcessMemory(1)
+	return err == nil
+}
+
+// get memory usage indicators from /proc/[pid]/smaps_rollup
+// usages are percent of MemTotal, sorted by pss like smem -s pss -r
+func (backend *procfsMemoryBackend) Indicators(ctx context.Context) ([]*Indicator, error) {
+	memInfo, err := ReadMemInfo()
+	if err != nil {
+		return nil, err
+	}
+	memTotal := float64(memInfo["MemTotal"])
+	if memTotal == 0 {
+		return nil, errors.New("MemTotal not found in meminfo")
+	}
+
+	pids, err := ListPids()
+	if err != nil {
+		return nil, err
+	}
+
+	selfPid := int32(os.Getpid())
+	indicators := make([]*Indicator, 0, len(pids))
+	for _, pid := range pids {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if pid == selfPid {
+			continue
+		}
+		// process may exit while reading, and kernel threads have no memory,
+		// but usage would be partial without access to other users' processes
+		processMemory, err := ReadProcessMemory(pid)
+		if errors.Is(err, os.ErrPermission) {
+			return nil, err
+		}
+		if err != nil || processMemory.Rss == 0 {
+			continue
+		}
+		command, err := ReadProcessCommand(pid)
+		if err != nil || command == "" {
+			continue
+		}
+
+		indicators = append(indicators, &Indicator{
+			UssMemUsage: float64(processMemory.Uss) / memTotal * 100,
+			PssMemUsage: float64(processMemory.Pss) / memTotal * 100,
+			RssMemUsage: float64(processMemory.Rss) / memTotal * 100,
+			SwapUsage:   float64(processMemory.Swap) / memTotal * 100,
+			Pid:         pid,
+			Command:     command,
+		})
+	}
+	if len(indicators) == 0 {
+		return nil, errors.New("no process memory readable from procfs")
+	}
+
+	sort.Slice(indicators, func(i, j int) bool {
+		return indicators[i].PssMemUsage > indicators[j].PssMemUsage
+	})
+
+	return indicators, nil
+}
+
+func (backend *smemMemoryBackend) Name() string {
+	return "smem"
+}
+
+// smem is a python script, it needs python or python3 besides itself
+func (backend *smemMemoryBackend) Available() bool {
+	if _, err := exec.LookPath("smem"); err != nil {
+		return false
+	}
+	for _, command := range []string{"python3", "python"} {
+		if _, err := exec.LookPath(command); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// get memory usage indicators by smem
+func (backend *smemMemoryBackend) Indicators(ctx context.Context) ([]*Indicator, error) {
+	cmd := `smem -s pss -rHp -c "pid uss pss command" | awk '{if(NR > 0) print "{\"uss_mem_usage\":" $2 ",\"pss_mem_usage\":" $3 ",\"command\":\""} {for (i=4;i<=NF;i++)printf("%s ", $i);}  {print "\",\"pid\":" $1 "}"}'`
+	result, err := commandOutput(ctx, "sh", "-c", cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsString := strings.Trim(string(result), "\n")
+	// trim \n
+	metricsString = strings.ReplaceAll(metricsString, "%", "")
+	metricsString = strings.ReplaceAll(metricsString, "\"command\":\"\n", "\"command\":\"")
+	metricsSlice := strings.Split(metricsString, "\n")
+
+	indicators := make([]*Indicator, 0)
+	for _, metric := range metricsSlice {
+		var rssIndicator = Indicator{}
+		metric = strings.ReplaceAll(metric, "\n", " ")
+		if err := json.Unmarshal([]byte(metric), &rssIndicator); err != nil {
+			// log.WithFields(log.Fields{"skip":7}).Error(err.Error())
+			// logtax.Println(err.Error())
+			continue
+		}
+		indicators = append(indicators, &rssIndicator)
+	}
+
+	return indicators, nil
+}
+
+func (backend *psMemoryBackend) Name() string {
+	return "ps"
+}
+
+func (backend *psMemoryBackend) Available() bool {
+	_, err := exec.LookPath("ps")
+	return err == nil
+}
+
+// get memory usage indicators by ps aux
+// ps only knows rss, it is used as upper bound of uss and pss as well
+func (backend *psMemoryBackend) Indicators(ctx context.Context) ([]*Indicator, error) {
+	// the header line is not json and skipped
+	metricsCmd := `ps aux | sort -r -n -k 4 | awk '{if(NR > 0) print "{\"rss_mem_usage\":" $4 ",\"pid\":" $2 ",\"command\":\""} {if(NR > 0) for (i=11;i<=NF;i++)printf("%s ", $i);}  {if(NR > 0) print "\"}"}'`
+
+	result, err := commandOutput(ctx, "sh", "-c", metricsCmd)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsString := strings.Trim(string(result), "\n")
+	// trim \n
+	metricsString = strings.ReplaceAll(metricsString, "\"command\":\"\n", "\"command\":\"")
+	metricsSlice := strings.Split(metricsString, "\n")
+
+	indicators := make([]*Indicator, 0)
+	for _, metric := range metricsSlice {
+		var indicator = Indicator{}
+		metric = strings.ReplaceAll(metric, "\n", " ")
+		if err := json.Unmarshal([]byte(metric), &indicator); err != nil {
+			continue
+		}
+		indicator.UssMemUsage = indicator.RssMemUsage
+		indicator.PssMemUsage = indicator.RssMemUsage
+		indicators = append(indicators, &indicator)
+	}
+	if len(indicators) == 0 {
+		return nil, errors.New("no process parsed from ps output")
+	}
+
+	return indicators, nil
+}
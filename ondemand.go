@@ -0,0 +1,78 @@
+// collect on /metrics requests instead of the ticker
+
+package exporter
+
+import (
+	"errors"
+	logtax "log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	CollectTimeoutErr = "collect timeout, serving previous values"
+)
+
+// on demand scraper runs a collection for a metrics request, concurrent
+// requests share the in flight collection and a finished one is reused
+// within the cache ttl
+type OnDemandScraper struct {
+	update   func()
+	timeout  time.Duration
+	ttl      time.Duration
+	mtx      sync.Mutex
+	inflight chan struct{} // closed when the in flight collection finishes
+	last     time.Time
+}
+
+func NewOnDemandScraper(update func(), timeout time.Duration, ttl time.Duration) *OnDemandScraper {
+	return &OnDemandScraper{
+		update:  update,
+		timeout: timeout,
+		ttl:     ttl,
+	}
+}
+
+// collect unless the last collection is fresh, wait for it at most the
+// timeout, a timed out collection keeps running and later requests join it
+func (scraper *OnDemandScraper) Scrape() error {
+	scraper.mtx.Lock()
+	if scraper.inflight == nil && time.Since(scraper.last) < scraper.ttl {
+		scraper.mtx.Unlock()
+		return nil
+	}
+	done := scraper.inflight
+	if done == nil {
+		done = make(chan struct{})
+		scraper.inflight = done
+		go func() {
+			scraper.update()
+			scraper.mtx.Lock()
+			scraper.last = time.Now()
+			scraper.inflight = nil
+			scraper.mtx.Unlock()
+			close(done)
+		}()
+	}
+	scraper.mtx.Unlock()
+
+	timer := time.NewTimer(scraper.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return errors.New(CollectTimeoutErr)
+	}
+}
+
+// collect before serving every request with the handler
+func (scraper *OnDemandScraper) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := scraper.Scrape(); err != nil {
+			logtax.Println(err.Error())
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
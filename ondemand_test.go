@@ -0,0 +1,96 @@
+package exporter
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOnDemandScraperConcurrent(t *testing.T) {
+	var updates int32
+	release := make(chan struct{})
+	scraper := NewOnDemandScraper(func() {
+		atomic.AddInt32(&updates, 1)
+		<-release
+	}, time.Second*5, time.Minute)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- scraper.Scrape()
+		}()
+	}
+	// let the requests pile up on the in flight collection
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Scrape() error = %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&updates); n != 1 {
+		t.Errorf("updates = %d, want 1", n)
+	}
+}
+
+func TestOnDemandScraperTTL(t *testing.T) {
+	var updates int32
+	scraper := NewOnDemandScraper(func() {
+		atomic.AddInt32(&updates, 1)
+	}, time.Second, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := scraper.Scrape(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&updates); n != 1 {
+		t.Errorf("updates within the ttl = %d, want 1", n)
+	}
+
+	// an expired collection is run again
+	scraper.mtx.Lock()
+	scraper.last = time.Now().Add(-time.Minute)
+	scraper.mtx.Unlock()
+	if err := scraper.Scrape(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&updates); n != 2 {
+		t.Errorf("updates after the ttl = %d, want 2", n)
+	}
+}
+
+func TestOnDemandScraperTimeoutJoins(t *testing.T) {
+	var updates int32
+	release := make(chan struct{})
+	scraper := NewOnDemandScraper(func() {
+		atomic.AddInt32(&updates, 1)
+		<-release
+	}, time.Millisecond*20, 0)
+
+	if err := scraper.Scrape(); err == nil || err.Error() != CollectTimeoutErr {
+		t.Fatalf("Scrape() error = %v, want %q", err, CollectTimeoutErr)
+	}
+
+	// the timed out collection keeps running, the next request joins it
+	done := make(chan error, 1)
+	scraper.timeout = time.Second * 5
+	go func() {
+		done <- scraper.Scrape()
+	}()
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("joined Scrape() error = %v", err)
+	}
+	if n := atomic.LoadInt32(&updates); n != 1 {
+		t.Errorf("updates = %d, want 1", n)
+	}
+}
@@ -0,0 +1,329 @@
+// export metrics by otlp/http protobuf
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	otlpTimeout      = time.Second * 10
+	otlpRetryBackoff = time.Millisecond * 500
+	// AggregationTemporality cumulative
+	otlpCumulative = 2
+)
+
+// otlp exporter posts every snapshot as an ExportMetricsServiceRequest,
+// host.name is a resource attribute, pid and command labels of process
+// series become process.pid and process.command attributes
+type OtlpExporter struct {
+	url       string
+	headers   map[string]string
+	host      string
+	retries   int
+	client    *http.Client
+	startTime time.Time
+}
+
+func NewOtlpExporter(url string, headers map[string]string, host string, retries int) *OtlpExporter {
+	return &OtlpExporter{
+		url:       url,
+		headers:   headers,
+		host:      host,
+		retries:   retries,
+		client:    &http.Client{Timeout: otlpTimeout},
+		startTime: time.Now(),
+	}
+}
+
+func (exporter *OtlpExporter) Name() string {
+	return "otlp"
+}
+
+// export a snapshot with retries, 4xx responses are not retried
+func (exporter *OtlpExporter) Send(snapshot *Snapshot) error {
+	var (
+		err     error
+		backoff = otlpRetryBackoff
+		body    = encodeOtlpRequest(snapshot, exporter.host, exporter.startTime)
+	)
+	for i := 0; i <= exporter.retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		if retry, err = exporter.post(body); err == nil || !retry {
+			return err
+		}
+	}
+
+	return fmt.Errorf("otlp export failed after %d retries: %v", exporter.retries, err)
+}
+
+func (exporter *OtlpExporter) Close() error {
+	return nil
+}
+
+// post a request, return whether to retry on error
+func (exporter *OtlpExporter) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, exporter.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range exporter.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "gexporter")
+
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("otlp server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+// ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+// Resource { repeated KeyValue attributes = 1; }
+// ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+// InstrumentationScope { string name = 1; }
+func encodeOtlpRequest(snapshot *Snapshot, host string, startTime time.Time) []byte {
+	var resource []byte
+	resource = appendOtlpMessage(resource, 1, otlpStringAttribute("host.name", host))
+	resource = appendOtlpMessage(resource, 1, otlpStringAttribute("service.name", "gexporter"))
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "gexporter")
+
+	var scopeMetrics []byte
+	scopeMetrics = appendOtlpMessage(scopeMetrics, 1, scope)
+	for _, family := range snapshot.Families {
+		if metric := encodeOtlpMetric(family, uint64(snapshot.Time.UnixNano()), uint64(startTime.UnixNano())); metric != nil {
+			scopeMetrics = appendOtlpMessage(scopeMetrics, 2, metric)
+		}
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendOtlpMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendOtlpMessage(resourceMetrics, 2, scopeMetrics)
+
+	return appendOtlpMessage(nil, 1, resourceMetrics)
+}
+
+// Metric { string name = 1; string description = 2; Gauge gauge = 5; Sum sum = 7; Histogram histogram = 9; Summary summary = 11; }
+// Gauge { repeated NumberDataPoint data_points = 1; }
+// Sum { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+// Histogram { repeated HistogramDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; }
+// Summary { repeated SummaryDataPoint data_points = 1; }
+func encodeOtlpMetric(family *dto.MetricFamily, now uint64, start uint64) []byte {
+	var (
+		data      []byte
+		dataField protowire.Number
+	)
+	for _, metric := range family.GetMetric() {
+		timestamp := now
+		if metric.TimestampMs != nil {
+			timestamp = uint64(metric.GetTimestampMs()) * uint64(time.Millisecond)
+		}
+		attributes := otlpAttributes(metric.GetLabel())
+
+		switch family.GetType() {
+		case dto.MetricType_GAUGE:
+			dataField = 5
+			data = appendOtlpMessage(data, 1, encodeOtlpNumberPoint(attributes, 0, timestamp, metric.GetGauge().GetValue()))
+		case dto.MetricType_UNTYPED:
+			dataField = 5
+			data = appendOtlpMessage(data, 1, encodeOtlpNumberPoint(attributes, 0, timestamp, metric.GetUntyped().GetValue()))
+		case dto.MetricType_COUNTER:
+			dataField = 7
+			data = appendOtlpMessage(data, 1, encodeOtlpNumberPoint(attributes, start, timestamp, metric.GetCounter().GetValue()))
+		case dto.MetricType_HISTOGRAM:
+			dataField = 9
+			data = appendOtlpMessage(data, 1, encodeOtlpHistogramPoint(attributes, start, timestamp, metric.GetHistogram()))
+		case dto.MetricType_SUMMARY:
+			dataField = 11
+			data = appendOtlpMessage(data, 1, encodeOtlpSummaryPoint(attributes, start, timestamp, metric.GetSummary()))
+		}
+	}
+	if data == nil {
+		return nil
+	}
+
+	switch dataField {
+	case 7:
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpCumulative)
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+	case 9:
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, otlpCumulative)
+	}
+
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, family.GetName())
+	metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+	metric = protowire.AppendString(metric, family.GetHelp())
+
+	return appendOtlpMessage(metric, dataField, data)
+}
+
+// NumberDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; double as_double = 4; }
+func encodeOtlpNumberPoint(attributes [][]byte, start uint64, timestamp uint64, value float64) []byte {
+	var point []byte
+	point = appendOtlpTimes(point, start, timestamp)
+	point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, math.Float64bits(value))
+	for _, attribute := range attributes {
+		point = appendOtlpMessage(point, 7, attribute)
+	}
+
+	return point
+}
+
+// HistogramDataPoint { repeated KeyValue attributes = 9; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+// fixed64 count = 4; double sum = 5; repeated fixed64 bucket_counts = 6; repeated double explicit_bounds = 7; }
+// bucket counts are not cumulative and have one more element for +Inf
+func encodeOtlpHistogramPoint(attributes [][]byte, start uint64, timestamp uint64, histogram *dto.Histogram) []byte {
+	var (
+		counts     []byte
+		bounds     []byte
+		cumulative uint64
+	)
+	for _, bucket := range histogram.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		counts = protowire.AppendFixed64(counts, bucket.GetCumulativeCount()-cumulative)
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bucket.GetUpperBound()))
+		cumulative = bucket.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, histogram.GetSampleCount()-cumulative)
+
+	var point []byte
+	point = appendOtlpTimes(point, start, timestamp)
+	point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, histogram.GetSampleCount())
+	point = protowire.AppendTag(point, 5, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, math.Float64bits(histogram.GetSampleSum()))
+	point = appendOtlpMessage(point, 6, counts)
+	if bounds != nil {
+		point = appendOtlpMessage(point, 7, bounds)
+	}
+	for _, attribute := range attributes {
+		point = appendOtlpMessage(point, 9, attribute)
+	}
+
+	return point
+}
+
+// SummaryDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+// fixed64 count = 4; double sum = 5; repeated ValueAtQuantile quantile_values = 6; }
+// ValueAtQuantile { double quantile = 1; double value = 2; }
+func encodeOtlpSummaryPoint(attributes [][]byte, start uint64, timestamp uint64, summary *dto.Summary) []byte {
+	var point []byte
+	point = appendOtlpTimes(point, start, timestamp)
+	point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, summary.GetSampleCount())
+	point = protowire.AppendTag(point, 5, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, math.Float64bits(summary.GetSampleSum()))
+	for _, quantile := range summary.GetQuantile() {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(quantile.GetQuantile()))
+		value = protowire.AppendTag(value, 2, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(quantile.GetValue()))
+		point = appendOtlpMessage(point, 6, value)
+	}
+	for _, attribute := range attributes {
+		point = appendOtlpMessage(point, 7, attribute)
+	}
+
+	return point
+}
+
+// start time is omitted for gauges
+func appendOtlpTimes(point []byte, start uint64, timestamp uint64) []byte {
+	if start > 0 {
+		point = protowire.AppendTag(point, 2, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, start)
+	}
+	point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+	return protowire.AppendFixed64(point, timestamp)
+}
+
+// labels as string attributes, pid and command as process attributes
+func otlpAttributes(labels []*dto.LabelPair) [][]byte {
+	attributes := make([][]byte, 0, len(labels))
+	for _, pair := range labels {
+		switch pair.GetName() {
+		case "pid":
+			if pid, err := strconv.ParseInt(pair.GetValue(), 10, 64); err == nil {
+				attributes = append(attributes, otlpIntAttribute("process.pid", pid))
+				continue
+			}
+		case "command":
+			attributes = append(attributes, otlpStringAttribute("process.command", pair.GetValue()))
+			continue
+		}
+		attributes = append(attributes, otlpStringAttribute(pair.GetName(), pair.GetValue()))
+	}
+
+	return attributes
+}
+
+// KeyValue { string key = 1; AnyValue value = 2; }
+// AnyValue { string string_value = 1; int64 int_value = 3; }
+func otlpStringAttribute(key string, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+
+	return otlpAttribute(key, anyValue)
+}
+
+func otlpIntAttribute(key string, value int64) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 3, protowire.VarintType)
+	anyValue = protowire.AppendVarint(anyValue, uint64(value))
+
+	return otlpAttribute(key, anyValue)
+}
+
+func otlpAttribute(key string, value []byte) []byte {
+	var attribute []byte
+	attribute = protowire.AppendTag(attribute, 1, protowire.BytesType)
+	attribute = protowire.AppendString(attribute, key)
+
+	return appendOtlpMessage(attribute, 2, value)
+}
+
+// append an embedded message or packed field
+func appendOtlpMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
@@ -0,0 +1,187 @@
+package exporter
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// the only field with the number, fails if there are none or several
+func protoFieldByNum(t *testing.T, fields []protoField, num protowire.Number) protoField {
+	t.Helper()
+	var found []protoField
+	for _, field := range fields {
+		if field.Num == num {
+			found = append(found, field)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("field %d found %d times in %+v", num, len(found), fields)
+	}
+	return found[0]
+}
+
+// decode KeyValue attributes of the field, values are string or int64
+func otlpAttributesOf(t *testing.T, fields []protoField, num protowire.Number) map[string]interface{} {
+	t.Helper()
+	attributes := make(map[string]interface{})
+	for _, field := range fields {
+		if field.Num != num {
+			continue
+		}
+		keyValue := decodeProtoFields(t, field.Bytes)
+		key := string(protoFieldByNum(t, keyValue, 1).Bytes)
+		value := decodeProtoFields(t, protoFieldByNum(t, keyValue, 2).Bytes)
+		switch value[0].Num {
+		case 1:
+			attributes[key] = string(value[0].Bytes)
+		case 3:
+			attributes[key] = int64(value[0].Varint)
+		default:
+			t.Fatalf("attribute %s has unexpected value field %d", key, value[0].Num)
+		}
+	}
+	return attributes
+}
+
+// decode a packed repeated fixed64 field
+func packedFixed64(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	values := make([]uint64, 0)
+	for len(b) > 0 {
+		v, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			t.Fatalf("bad packed fixed64: %v", protowire.ParseError(n))
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values
+}
+
+func TestEncodeOtlpRequest(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "process_workload_usage",
+		Help: "usage",
+	}, []string{"command", "pid", "type"})
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sends_total",
+		Help: "sends",
+	})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "load",
+		Help:    "load",
+		Buckets: []float64{1, 2},
+	})
+	registry.MustRegister(gauge, counter, histogram)
+	gauge.WithLabelValues("nginx", "42", "cpu").Set(12.5)
+	counter.Add(3)
+	histogram.Observe(0.5)
+	histogram.Observe(1.5)
+	histogram.Observe(5)
+
+	snapshot, err := GatherSnapshot(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Time = time.Unix(1600000000, 0)
+	startTime := time.Unix(1500000000, 0)
+	request := encodeOtlpRequest(snapshot, "h1", startTime)
+
+	resourceMetrics := decodeProtoFields(t, protoFieldByNum(t, decodeProtoFields(t, request), 1).Bytes)
+	resource := decodeProtoFields(t, protoFieldByNum(t, resourceMetrics, 1).Bytes)
+	resourceAttributes := otlpAttributesOf(t, resource, 1)
+	if resourceAttributes["host.name"] != "h1" || resourceAttributes["service.name"] != "gexporter" {
+		t.Errorf("resource attributes = %v", resourceAttributes)
+	}
+
+	scopeMetrics := decodeProtoFields(t, protoFieldByNum(t, resourceMetrics, 2).Bytes)
+	scope := decodeProtoFields(t, protoFieldByNum(t, scopeMetrics, 1).Bytes)
+	if name := string(protoFieldByNum(t, scope, 1).Bytes); name != "gexporter" {
+		t.Errorf("scope name = %q", name)
+	}
+
+	metrics := make(map[string][]protoField)
+	for _, field := range scopeMetrics {
+		if field.Num == 2 {
+			metric := decodeProtoFields(t, field.Bytes)
+			metrics[string(protoFieldByNum(t, metric, 1).Bytes)] = metric
+		}
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("metrics = %d, want 3", len(metrics))
+	}
+	now := uint64(snapshot.Time.UnixNano())
+	start := uint64(startTime.UnixNano())
+
+	t.Run("gauge", func(t *testing.T) {
+		metric := metrics["process_workload_usage"]
+		if help := string(protoFieldByNum(t, metric, 2).Bytes); help != "usage" {
+			t.Errorf("description = %q", help)
+		}
+		data := decodeProtoFields(t, protoFieldByNum(t, metric, 5).Bytes)
+		point := decodeProtoFields(t, protoFieldByNum(t, data, 1).Bytes)
+		for _, field := range point {
+			if field.Num == 2 {
+				t.Errorf("gauge point has a start time")
+			}
+		}
+		if timestamp := protoFieldByNum(t, point, 3).Fixed64; timestamp != now {
+			t.Errorf("time = %d, want %d", timestamp, now)
+		}
+		if value := math.Float64frombits(protoFieldByNum(t, point, 4).Fixed64); value != 12.5 {
+			t.Errorf("value = %v, want 12.5", value)
+		}
+		attributes := otlpAttributesOf(t, point, 7)
+		if len(attributes) != 3 || attributes["process.command"] != "nginx" || attributes["process.pid"] != int64(42) || attributes["type"] != "cpu" {
+			t.Errorf("attributes = %v", attributes)
+		}
+	})
+
+	t.Run("counter", func(t *testing.T) {
+		data := decodeProtoFields(t, protoFieldByNum(t, metrics["sends_total"], 7).Bytes)
+		if temporality := protoFieldByNum(t, data, 2).Varint; temporality != otlpCumulative {
+			t.Errorf("aggregation temporality = %d, want cumulative", temporality)
+		}
+		if monotonic := protoFieldByNum(t, data, 3).Varint; monotonic != 1 {
+			t.Errorf("is_monotonic = %d, want true", monotonic)
+		}
+		point := decodeProtoFields(t, protoFieldByNum(t, data, 1).Bytes)
+		if startTime := protoFieldByNum(t, point, 2).Fixed64; startTime != start {
+			t.Errorf("start time = %d, want %d", startTime, start)
+		}
+		if timestamp := protoFieldByNum(t, point, 3).Fixed64; timestamp != now {
+			t.Errorf("time = %d, want %d", timestamp, now)
+		}
+		if value := math.Float64frombits(protoFieldByNum(t, point, 4).Fixed64); value != 3 {
+			t.Errorf("value = %v, want 3", value)
+		}
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		data := decodeProtoFields(t, protoFieldByNum(t, metrics["load"], 9).Bytes)
+		if temporality := protoFieldByNum(t, data, 2).Varint; temporality != otlpCumulative {
+			t.Errorf("aggregation temporality = %d, want cumulative", temporality)
+		}
+		point := decodeProtoFields(t, protoFieldByNum(t, data, 1).Bytes)
+		if count := protoFieldByNum(t, point, 4).Fixed64; count != 3 {
+			t.Errorf("count = %d, want 3", count)
+		}
+		if sum := math.Float64frombits(protoFieldByNum(t, point, 5).Fixed64); sum != 7 {
+			t.Errorf("sum = %v, want 7", sum)
+		}
+		// one observation per bucket, the last one is +Inf
+		counts := packedFixed64(t, protoFieldByNum(t, point, 6).Bytes)
+		if len(counts) != 3 || counts[0] != 1 || counts[1] != 1 || counts[2] != 1 {
+			t.Errorf("bucket counts = %v, want [1 1 1]", counts)
+		}
+		bounds := packedFixed64(t, protoFieldByNum(t, point, 7).Bytes)
+		if len(bounds) != 2 || math.Float64frombits(bounds[0]) != 1 || math.Float64frombits(bounds[1]) != 2 {
+			t.Errorf("explicit bounds = %v, want [1 2]", bounds)
+		}
+	})
+}
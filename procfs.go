@@ -0,0 +1,465 @@
+// read kernel statistics from procfs
+
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// clock ticks per second of /proc time counters, fixed on every supported arch
+	userHz = 100
+)
+
+var (
+	procFsPath = "/proc"
+)
+
+// cpu time counters of one cpu line in /proc/stat, in USER_HZ
+type CpuTimes struct {
+	Cpu       string
+	User      uint64
+	Nice      uint64
+	System    uint64
+	Idle      uint64
+	Iowait    uint64
+	Irq       uint64
+	Softirq   uint64
+	Steal     uint64
+	Guest     uint64
+	GuestNice uint64
+}
+
+// parsed /proc/stat
+type ProcStat struct {
+	Total           CpuTimes   // aggregate cpu line
+	Cpus            []CpuTimes // cpuN lines
+	ContextSwitches uint64
+	BootTime        uint64
+	Processes       uint64
+	ProcsRunning    uint64
+	ProcsBlocked    uint64
+}
+
+// get counter by cpuUsageType name
+func (t CpuTimes) Get(name string) float64 {
+	switch name {
+	case "user":
+		return float64(t.User)
+	case "nice":
+		return float64(t.Nice)
+	case "system":
+		return float64(t.System)
+	case "idle":
+		return float64(t.Idle)
+	case "iowait":
+		return float64(t.Iowait)
+	case "irq":
+		return float64(t.Irq)
+	case "softirq":
+		return float64(t.Softirq)
+	case "steal":
+		return float64(t.Steal)
+	case "guest":
+		return float64(t.Guest)
+	case "guest_nice":
+		return float64(t.GuestNice)
+	}
+	return 0
+}
+
+// sum of cpuUsageType counters, guest and guest_nice are left out as
+// the kernel already counts them in user and nice
+func (t CpuTimes) Total() float64 {
+	var total float64
+	for _, f := range cpuUsageType {
+		if f == "guest" || f == "guest_nice" {
+			continue
+		}
+		total += t.Get(f)
+	}
+	return total
+}
+
+// path under procfs
+func procFile(elem ...string) string {
+	return filepath.Join(append([]string{procFsPath}, elem...)...)
+}
+
+// read and parse /proc/stat
+func ReadProcStat() (*ProcStat, error) {
+	file, err := os.Open(procFile("stat"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseProcStat(file)
+}
+
+func parseProcStat(r io.Reader) (*ProcStat, error) {
+	var (
+		stat      = &ProcStat{}
+		seenTotal bool
+		scanner   = bufio.NewScanner(r)
+	)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "cpu":
+			stat.Total, err = parseCpuTimes(fields)
+			seenTotal = true
+		case strings.HasPrefix(fields[0], "cpu"):
+			var times CpuTimes
+			if times, err = parseCpuTimes(fields); err == nil {
+				stat.Cpus = append(stat.Cpus, times)
+			}
+		case fields[0] == "ctxt":
+			stat.ContextSwitches, err = strconv.ParseUint(fields[1], 10, 64)
+		case fields[0] == "btime":
+			stat.BootTime, err = strconv.ParseUint(fields[1], 10, 64)
+		case fields[0] == "processes":
+			stat.Processes, err = strconv.ParseUint(fields[1], 10, 64)
+		case fields[0] == "procs_running":
+			stat.ProcsRunning, err = strconv.ParseUint(fields[1], 10, 64)
+		case fields[0] == "procs_blocked":
+			stat.ProcsBlocked, err = strconv.ParseUint(fields[1], 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse /proc/stat line %q: %w", scanner.Text(), err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !seenTotal {
+		return nil, fmt.Errorf("parse /proc/stat: cpu line not found")
+	}
+
+	return stat, nil
+}
+
+// parse a cpu line, older kernels omit the trailing counters
+func parseCpuTimes(fields []string) (CpuTimes, error) {
+	times := CpuTimes{Cpu: fields[0]}
+	counters := []*uint64{
+		&times.User, &times.Nice, &times.System, &times.Idle, &times.Iowait,
+		&times.Irq, &times.Softirq, &times.Steal, &times.Guest, &times.GuestNice,
+	}
+
+	values := fields[1:]
+	if len(values) > len(counters) {
+		values = values[:len(counters)]
+	}
+	for i, v := range values {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return times, err
+		}
+		*counters[i] = n
+	}
+
+	return times, nil
+}
+
+// parsed /proc/loadavg
+type LoadAvg struct {
+	Load1        float64
+	Load5        float64
+	Load15       float64
+	RunningTasks uint64 // currently runnable scheduling entities
+	TotalTasks   uint64 // scheduling entities that currently exist
+	LastPid      uint64 // pid most recently assigned
+}
+
+// read and parse /proc/loadavg
+func ReadLoadAvg() (*LoadAvg, error) {
+	content, err := ioutil.ReadFile(procFile("loadavg"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLoadAvg(string(content))
+}
+
+func parseLoadAvg(content string) (*LoadAvg, error) {
+	fields := strings.Fields(content)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("parse /proc/loadavg: unexpected content %q", content)
+	}
+
+	var (
+		load = &LoadAvg{}
+		err  error
+	)
+	for i, v := range []*float64{&load.Load1, &load.Load5, &load.Load15} {
+		if *v, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return nil, fmt.Errorf("parse /proc/loadavg: %w", err)
+		}
+	}
+
+	tasks := strings.Split(fields[3], "/")
+	if len(tasks) != 2 {
+		return nil, fmt.Errorf("parse /proc/loadavg: unexpected tasks field %q", fields[3])
+	}
+	if load.RunningTasks, err = strconv.ParseUint(tasks[0], 10, 64); err != nil {
+		return nil, fmt.Errorf("parse /proc/loadavg: %w", err)
+	}
+	if load.TotalTasks, err = strconv.ParseUint(tasks[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("parse /proc/loadavg: %w", err)
+	}
+	if load.LastPid, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+		return nil, fmt.Errorf("parse /proc/loadavg: %w", err)
+	}
+
+	return load, nil
+}
+
+// read the first processor block of /proc/cpuinfo as key value pairs,
+// the available keys differ between architectures
+func ReadCpuInfo() (map[string]string, error) {
+	file, err := os.Open(procFile("cpuinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(info) > 0 {
+				break
+			}
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return info, scanner.Err()
+}
+
+// parsed /proc/[pid]/stat, times are in USER_HZ
+type ProcessStat struct {
+	Pid       int32
+	Comm      string
+	State     string
+	Ppid      int32
+	Utime     uint64
+	Stime     uint64
+	StartTime uint64 // since boot
+}
+
+// list pids of running processes
+func ListPids() ([]int32, error) {
+	entries, err := ioutil.ReadDir(procFsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make([]int32, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		pids = append(pids, int32(pid))
+	}
+
+	return pids, nil
+}
+
+// read and parse /proc/[pid]/stat
+func ReadProcessStat(pid int32) (*ProcessStat, error) {
+	content, err := ioutil.ReadFile(procFile(strconv.FormatInt(int64(pid), 10), "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseProcessStat(string(content))
+}
+
+func parseProcessStat(content string) (*ProcessStat, error) {
+	// comm may contain spaces and parentheses, it ends at the last ')'
+	commStart := strings.IndexByte(content, '(')
+	commEnd := strings.LastIndexByte(content, ')')
+	if commStart < 0 || commEnd < commStart {
+		return nil, fmt.Errorf("parse process stat: unexpected content %q", content)
+	}
+
+	pid, err := strconv.ParseInt(strings.TrimSpace(content[:commStart]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse process stat: %w", err)
+	}
+
+	// fields after comm, starting with state (field 3)
+	fields := strings.Fields(content[commEnd+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("parse process stat: unexpected content %q", content)
+	}
+
+	stat := &ProcessStat{
+		Pid:   int32(pid),
+		Comm:  content[commStart+1 : commEnd],
+		State: fields[0],
+	}
+	ppid, err := strconv.ParseInt(fields[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse process stat: %w", err)
+	}
+	stat.Ppid = int32(ppid)
+	for i, v := range map[int]*uint64{11: &stat.Utime, 12: &stat.Stime, 19: &stat.StartTime} {
+		if *v, err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+			return nil, fmt.Errorf("parse process stat: %w", err)
+		}
+	}
+
+	return stat, nil
+}
+
+// read /proc/meminfo, values are converted to bytes
+func ReadMemInfo() (map[string]uint64, error) {
+	file, err := os.Open(procFile("meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	memInfo := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// e.g. "MemTotal:       16318412 kB", HugePages_* have no unit
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse /proc/meminfo line %q: %w", scanner.Text(), err)
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			value *= 1024
+		}
+		memInfo[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	return memInfo, scanner.Err()
+}
+
+// memory of a process, in bytes
+type ProcessMemory struct {
+	Rss  uint64
+	Pss  uint64
+	Uss  uint64 // Private_Clean + Private_Dirty
+	Swap uint64
+}
+
+// read process memory from smaps_rollup, fall back to summing smaps
+// on kernels older than 4.14
+func ReadProcessMemory(pid int32) (*ProcessMemory, error) {
+	dir := strconv.FormatInt(int64(pid), 10)
+	file, err := os.Open(procFile(dir, "smaps_rollup"))
+	if os.IsNotExist(err) {
+		file, err = os.Open(procFile(dir, "smaps"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseSmaps(file)
+}
+
+// sum the fields of smaps or smaps_rollup
+func parseSmaps(r io.Reader) (*ProcessMemory, error) {
+	memory := &ProcessMemory{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// e.g. "Pss:                 123 kB", mapping header lines are skipped
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+
+		var counter *uint64
+		switch fields[0] {
+		case "Rss:":
+			counter = &memory.Rss
+		case "Pss:":
+			counter = &memory.Pss
+		case "Private_Clean:", "Private_Dirty:":
+			counter = &memory.Uss
+		case "Swap:":
+			counter = &memory.Swap
+		default:
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse smaps line %q: %w", scanner.Text(), err)
+		}
+		*counter += value * 1024
+	}
+
+	return memory, scanner.Err()
+}
+
+// read argv[0] of /proc/[pid]/cmdline, empty for kernel threads
+func ReadProcessCommand(pid int32) (string, error) {
+	content, err := ioutil.ReadFile(procFile(strconv.FormatInt(int64(pid), 10), "cmdline"))
+	if err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(content, 0); i >= 0 {
+		content = content[:i]
+	}
+	return string(content), nil
+}
+
+// read real uid from /proc/[pid]/status
+func ReadProcessUid(pid int32) (uint32, error) {
+	file, err := os.Open(procFile(strconv.FormatInt(int64(pid), 10), "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// e.g. "Uid:	1000	1000	1000	1000", real uid first
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "Uid:" {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("parse process status: %w", err)
+		}
+		return uint32(uid), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("parse process status: Uid not found")
+}
@@ -0,0 +1,270 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const procStatFixture = `cpu  10 20 30 400 50 6 7 8 90 100
+cpu0 5 10 15 200 25 3 4 4 45 50
+cpu1 5 10 15 200 25 3 3 4 45 50
+intr 12345 0 0
+ctxt 987654
+btime 1600000000
+processes 4321
+procs_running 3
+procs_blocked 1
+softirq 100 0 0
+`
+
+func TestParseProcStat(t *testing.T) {
+	stat, err := parseProcStat(strings.NewReader(procStatFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := CpuTimes{Cpu: "cpu", User: 10, Nice: 20, System: 30, Idle: 400, Iowait: 50, Irq: 6, Softirq: 7, Steal: 8, Guest: 90, GuestNice: 100}
+	if stat.Total != want {
+		t.Errorf("total = %+v, want %+v", stat.Total, want)
+	}
+	if len(stat.Cpus) != 2 || stat.Cpus[0].Cpu != "cpu0" || stat.Cpus[1].Cpu != "cpu1" || stat.Cpus[1].Softirq != 3 {
+		t.Errorf("cpus = %+v", stat.Cpus)
+	}
+	if stat.ContextSwitches != 987654 || stat.BootTime != 1600000000 || stat.Processes != 4321 || stat.ProcsRunning != 3 || stat.ProcsBlocked != 1 {
+		t.Errorf("stat = %+v", stat)
+	}
+	// guest and guest_nice are already counted in user and nice
+	if total := stat.Total.Total(); total != 531 {
+		t.Errorf("Total() = %v, want 531", total)
+	}
+}
+
+func TestParseProcStatShortCpuLine(t *testing.T) {
+	// kernels before 2.6.11 have no steal, before 2.6.24 no guest
+	stat, err := parseProcStat(strings.NewReader("cpu  1 2 3 4 5 6 7\ncpu0 1 2 3 4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := CpuTimes{Cpu: "cpu", User: 1, Nice: 2, System: 3, Idle: 4, Iowait: 5, Irq: 6, Softirq: 7}
+	if stat.Total != want {
+		t.Errorf("total = %+v, want %+v", stat.Total, want)
+	}
+	if len(stat.Cpus) != 1 || stat.Cpus[0].Idle != 4 || stat.Cpus[0].Iowait != 0 {
+		t.Errorf("cpus = %+v", stat.Cpus)
+	}
+	if total := stat.Total.Total(); total != 28 {
+		t.Errorf("Total() = %v, want 28", total)
+	}
+}
+
+func TestParseProcStatErrors(t *testing.T) {
+	cases := map[string]string{
+		"no cpu line": "ctxt 1\n",
+		"bad counter": "cpu  1 x 3 4\n",
+		"bad ctxt":    "cpu  1 2 3 4\nctxt -1\n",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseProcStat(strings.NewReader(content)); err == nil {
+				t.Errorf("parseProcStat(%q) succeeded", content)
+			}
+		})
+	}
+}
+
+func TestParseLoadAvg(t *testing.T) {
+	load, err := parseLoadAvg("0.52 0.58 0.59 2/1093 24567\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LoadAvg{Load1: 0.52, Load5: 0.58, Load15: 0.59, RunningTasks: 2, TotalTasks: 1093, LastPid: 24567}
+	if *load != want {
+		t.Errorf("load = %+v, want %+v", *load, want)
+	}
+
+	for _, content := range []string{"", "0.5 0.5 0.5 2/10", "0.5 0.5 0.5 2-10 1", "0.5 x 0.5 2/10 1", "0.5 0.5 0.5 2/10 -1"} {
+		if _, err := parseLoadAvg(content); err == nil {
+			t.Errorf("parseLoadAvg(%q) succeeded", content)
+		}
+	}
+}
+
+func TestParseProcessStat(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		comm    string
+	}{
+		{
+			name:    "plain",
+			content: "42 (nginx) S 1 42 42 0 -1 4194560 100 0 0 0 1500 250 0 0 20 0 1 0 98765 1000000 200 18446744073709551615\n",
+			comm:    "nginx",
+		},
+		{
+			name:    "comm with spaces and parentheses",
+			content: "42 (a) (b c) S 1 42 42 0 -1 4194560 100 0 0 0 1500 250 0 0 20 0 1 0 98765 1000000 200 18446744073709551615\n",
+			comm:    "a) (b c",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stat, err := parseProcessStat(c.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ProcessStat{Pid: 42, Comm: c.comm, State: "S", Ppid: 1, Utime: 1500, Stime: 250, StartTime: 98765}
+			if *stat != want {
+				t.Errorf("stat = %+v, want %+v", *stat, want)
+			}
+		})
+	}
+
+	for _, content := range []string{"", "42 nginx S 1", "42 (nginx) S 1 42 42", "x (nginx) S 1 42 42 0 -1 4194560 100 0 0 0 1500 250 0 0 20 0 1 0 98765 1000000"} {
+		if _, err := parseProcessStat(content); err == nil {
+			t.Errorf("parseProcessStat(%q) succeeded", content)
+		}
+	}
+}
+
+const smapsFixture = `00400000-0040b000 r-xp 00000000 08:01 1234    /usr/sbin/nginx
+Size:                 44 kB
+Rss:                  40 kB
+Pss:                  20 kB
+Shared_Clean:         20 kB
+Shared_Dirty:          0 kB
+Private_Clean:        16 kB
+Private_Dirty:         4 kB
+Swap:                  0 kB
+SwapPss:               0 kB
+VmFlags: rd ex mr mw me dw
+7ffd1000-7ffd2000 rw-p 00000000 00:00 0       [stack]
+Size:                132 kB
+Rss:                  12 kB
+Pss:                  12 kB
+Private_Clean:         0 kB
+Private_Dirty:        12 kB
+Swap:                  8 kB
+SwapPss:               8 kB
+VmFlags: rd wr mr mw me gd ac
+`
+
+const smapsRollupFixture = `00400000-7ffd2000 ---p 00000000 00:00 0                                  [rollup]
+Rss:                  52 kB
+Pss:                  32 kB
+Pss_Anon:             12 kB
+Pss_File:             20 kB
+Shared_Clean:         20 kB
+Shared_Dirty:          0 kB
+Private_Clean:        16 kB
+Private_Dirty:        16 kB
+Swap:                  8 kB
+SwapPss:               8 kB
+`
+
+// point procfs at a fixture directory of files for the test
+func procFsFixture(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "procfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := procFsPath
+	procFsPath = dir
+	t.Cleanup(func() {
+		procFsPath = old
+		_ = os.RemoveAll(dir)
+	})
+}
+
+func TestParseSmaps(t *testing.T) {
+	// smaps and smaps_rollup of the same process sum up alike
+	want := ProcessMemory{Rss: 52 * 1024, Pss: 32 * 1024, Uss: 32 * 1024, Swap: 8 * 1024}
+	for name, content := range map[string]string{"smaps": smapsFixture, "smaps_rollup": smapsRollupFixture} {
+		t.Run(name, func(t *testing.T) {
+			memory, err := parseSmaps(strings.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *memory != want {
+				t.Errorf("memory = %+v, want %+v", *memory, want)
+			}
+		})
+	}
+}
+
+func TestReadProcessMemory(t *testing.T) {
+	procFsFixture(t, map[string]string{
+		"42/smaps_rollup": smapsRollupFixture,
+		"42/smaps":        "Rss:                   1 kB\n",
+		"43/smaps":        smapsFixture,
+	})
+
+	// smaps_rollup is preferred, smaps is read on kernels without it
+	for _, pid := range []int32{42, 43} {
+		memory, err := ReadProcessMemory(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if memory.Rss != 52*1024 || memory.Pss != 32*1024 {
+			t.Errorf("pid %d memory = %+v", pid, *memory)
+		}
+	}
+	if _, err := ReadProcessMemory(44); !os.IsNotExist(err) {
+		t.Errorf("ReadProcessMemory() of a missing pid error = %v", err)
+	}
+}
+
+func TestReadMemInfo(t *testing.T) {
+	procFsFixture(t, map[string]string{
+		"meminfo": `MemTotal:       16318412 kB
+MemFree:         1234567 kB
+MemAvailable:    8765432 kB
+SwapTotal:             0 kB
+HugePages_Total:       4
+HugePages_Free:        2
+Hugepagesize:       2048 kB
+`,
+	})
+
+	memInfo, err := ReadMemInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{
+		"MemTotal":        16318412 * 1024,
+		"MemFree":         1234567 * 1024,
+		"MemAvailable":    8765432 * 1024,
+		"SwapTotal":       0,
+		"HugePages_Total": 4,
+		"HugePages_Free":  2,
+		"Hugepagesize":    2048 * 1024,
+	}
+	if len(memInfo) != len(want) {
+		t.Errorf("meminfo = %v, want %v", memInfo, want)
+	}
+	for name, value := range want {
+		if memInfo[name] != value {
+			t.Errorf("%s = %d, want %d", name, memInfo[name], value)
+		}
+	}
+}
+
+func TestReadMemInfoError(t *testing.T) {
+	procFsFixture(t, map[string]string{"meminfo": "MemTotal:       x kB\n"})
+	if _, err := ReadMemInfo(); err == nil {
+		t.Error("ReadMemInfo() succeeded on a bad value")
+	}
+}
@@ -0,0 +1,86 @@
+// push metrics to pushgateway
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"time"
+)
+
+const (
+	pushGatewayRetryBackoff = time.Millisecond * 500
+)
+
+// push gateway pusher pushes the registry after each scrape
+// grouped by job and instance
+type PushGatewayPusher struct {
+	pusher           *push.Pusher
+	gatherer         *snapshotGatherer
+	method           string
+	retries          int
+	backoff          time.Duration
+	deleteOnShutdown bool
+}
+
+// method is push, replacing all metrics of the group,
+// or add, replacing only metrics with the same name
+func NewPushGatewayPusher(url string, job string, instance string, method string, retries int, deleteOnShutdown bool) *PushGatewayPusher {
+	gatherer := &snapshotGatherer{}
+	return &PushGatewayPusher{
+		pusher:           push.New(url, job).Gatherer(gatherer).Grouping("instance", instance),
+		gatherer:         gatherer,
+		method:           method,
+		retries:          retries,
+		backoff:          pushGatewayRetryBackoff,
+		deleteOnShutdown: deleteOnShutdown,
+	}
+}
+
+func (p *PushGatewayPusher) Name() string {
+	return "pushgateway"
+}
+
+// push a snapshot
+func (p *PushGatewayPusher) Send(snapshot *Snapshot) error {
+	p.gatherer.set(snapshot)
+	return p.Push()
+}
+
+// delete the pushed metrics if configured
+func (p *PushGatewayPusher) Close() error {
+	if !p.deleteOnShutdown {
+		return nil
+	}
+	return p.Delete()
+}
+
+// push the last snapshot with retries, the backoff doubles after every failure
+func (p *PushGatewayPusher) Push() error {
+	var (
+		err     error
+		backoff = p.backoff
+	)
+	for i := 0; i <= p.retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if p.method == "add" {
+			err = p.pusher.Add()
+		} else {
+			err = p.pusher.Push()
+		}
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("push to pushgateway failed after %d retries: %v", p.retries, err)
+}
+
+// delete all metrics of the group
+func (p *PushGatewayPusher) Delete() error {
+	return p.pusher.Delete()
+}
@@ -0,0 +1,103 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pushgateway stub recording the requests and answering with status
+type pushGatewayStub struct {
+	mtx      sync.Mutex
+	status   int
+	methods  []string
+	paths    []string
+	lastBody string
+}
+
+func (stub *pushGatewayStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	stub.mtx.Lock()
+	stub.methods = append(stub.methods, r.Method)
+	stub.paths = append(stub.paths, r.URL.Path)
+	stub.lastBody = string(body)
+	stub.mtx.Unlock()
+	w.WriteHeader(stub.status)
+}
+
+func TestPushGatewayPusherMethods(t *testing.T) {
+	cases := []struct {
+		method string
+		want   string
+	}{
+		{method: "push", want: http.MethodPut},
+		{method: "add", want: http.MethodPost},
+	}
+	for _, c := range cases {
+		t.Run(c.method, func(t *testing.T) {
+			stub := &pushGatewayStub{status: http.StatusAccepted}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			pusher := NewPushGatewayPusher(server.URL, "gexporter", "host1", c.method, 0, true)
+			if err := pusher.Send(testSnapshot(t)); err != nil {
+				t.Fatal(err)
+			}
+			if err := pusher.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			wantMethods := []string{c.want, http.MethodDelete}
+			if strings.Join(stub.methods, ",") != strings.Join(wantMethods, ",") {
+				t.Errorf("methods = %v, want %v", stub.methods, wantMethods)
+			}
+			for _, path := range stub.paths {
+				if path != "/metrics/job/gexporter/instance/host1" {
+					t.Errorf("path = %s, want the job and instance grouping path", path)
+				}
+			}
+		})
+	}
+}
+
+func TestPushGatewayPusherBody(t *testing.T) {
+	stub := &pushGatewayStub{status: http.StatusAccepted}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	pusher := NewPushGatewayPusher(server.URL, "gexporter", "host1", "push", 0, false)
+	if err := pusher.Send(testSnapshot(t)); err != nil {
+		t.Fatal(err)
+	}
+	// protobuf delimited, label values appear verbatim
+	for _, want := range []string{"process_workload_usage", "nginx"} {
+		if !strings.Contains(stub.lastBody, want) {
+			t.Errorf("pushed body does not contain %q", want)
+		}
+	}
+	// delete on shutdown is off
+	if err := pusher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.methods) != 1 {
+		t.Errorf("requests = %v, want only the push", stub.methods)
+	}
+}
+
+func TestPushGatewayPusherErrorStatus(t *testing.T) {
+	stub := &pushGatewayStub{status: http.StatusInternalServerError}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	pusher := NewPushGatewayPusher(server.URL, "gexporter", "host1", "push", 2, false)
+	pusher.backoff = 0
+	if err := pusher.Send(testSnapshot(t)); err == nil {
+		t.Fatal("push succeeded on status 500")
+	}
+	if len(stub.methods) != 3 {
+		t.Errorf("requests = %d, want 1 push and 2 retries", len(stub.methods))
+	}
+}
@@ -0,0 +1,341 @@
+// push metrics by prometheus remote_write protocol
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"io/ioutil"
+	logtax "log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	remoteWriteTimeout      = time.Second * 10
+	remoteWriteRetryBackoff = time.Millisecond * 500
+)
+
+// a sample of remote_write protocol
+type remoteWriteSample struct {
+	Value     float64
+	Timestamp int64 // in milliseconds
+}
+
+// a series of remote_write protocol, labels sorted by name
+type remoteWriteSeries struct {
+	Labels  []*dto.LabelPair
+	Samples []remoteWriteSample
+}
+
+// remote writer sends gathered metrics as snappy compressed
+// WriteRequest protobuf, batches are queued and sent in background
+type RemoteWriter struct {
+	url         string
+	headers     map[string]string
+	instance    string
+	batchSize   int
+	retries     int
+	client      *http.Client
+	queue       chan []*remoteWriteSeries
+	wg          sync.WaitGroup
+	stopTimeout time.Duration
+	ctx         context.Context // canceled when the stop deadline expires
+	cancel      context.CancelFunc
+}
+
+// batchSize is the max samples of a request, queueSize the max pending requests,
+// stopTimeout bounds sending the queued batches on stop
+func NewRemoteWriter(url string, headers map[string]string, instance string, batchSize int, queueSize int, retries int, stopTimeout time.Duration) *RemoteWriter {
+	writer := &RemoteWriter{
+		url:         url,
+		headers:     headers,
+		instance:    instance,
+		batchSize:   batchSize,
+		retries:     retries,
+		client:      &http.Client{Timeout: remoteWriteTimeout},
+		queue:       make(chan []*remoteWriteSeries, queueSize),
+		stopTimeout: stopTimeout,
+	}
+	writer.ctx, writer.cancel = context.WithCancel(context.Background())
+
+	writer.wg.Add(1)
+	go writer.run()
+
+	return writer
+}
+
+func (writer *RemoteWriter) Name() string {
+	return "remote_write"
+}
+
+// queue a snapshot
+func (writer *RemoteWriter) Send(snapshot *Snapshot) error {
+	return writer.Write(snapshot.Families, snapshot.Time)
+}
+
+// send the queued batches, at most the stop timeout
+func (writer *RemoteWriter) Close() error {
+	writer.Stop()
+	return nil
+}
+
+// convert families to series and queue them in batches,
+// batches are dropped when the queue is full
+func (writer *RemoteWriter) Write(families []*dto.MetricFamily, now time.Time) error {
+	var (
+		batch   = make([]*remoteWriteSeries, 0)
+		dropped int
+	)
+	enqueue := func() {
+		select {
+		case writer.queue <- batch:
+		default:
+			dropped++
+		}
+		batch = make([]*remoteWriteSeries, 0)
+	}
+
+	for _, series := range familiesToSeries(families, writer.instance, now) {
+		batch = append(batch, series)
+		if len(batch) >= writer.batchSize {
+			enqueue()
+		}
+	}
+	if len(batch) > 0 {
+		enqueue()
+	}
+
+	if dropped > 0 {
+		return fmt.Errorf("remote write queue full, %d batches dropped", dropped)
+	}
+	return nil
+}
+
+// stop accepting batches and wait for the queued ones to be sent, the
+// batches left when the stop timeout expires are dropped
+func (writer *RemoteWriter) Stop() {
+	close(writer.queue)
+	timer := time.AfterFunc(writer.stopTimeout, writer.cancel)
+	defer timer.Stop()
+	writer.wg.Wait()
+	writer.cancel()
+}
+
+func (writer *RemoteWriter) run() {
+	defer writer.wg.Done()
+	var dropped int
+	for batch := range writer.queue {
+		if writer.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		if err := writer.send(encodeWriteRequest(batch)); err != nil {
+			if writer.ctx.Err() != nil {
+				dropped++
+				continue
+			}
+			logtax.Println(err.Error())
+		}
+	}
+	if dropped > 0 {
+		logtax.Printf("remote write stop timeout, %d batches dropped", dropped)
+	}
+}
+
+// send with retries, 4xx responses are not retried
+func (writer *RemoteWriter) send(request []byte) error {
+	var (
+		err     error
+		backoff = remoteWriteRetryBackoff
+		body    = snappy.Encode(nil, request)
+	)
+	for i := 0; i <= writer.retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-writer.ctx.Done():
+				return writer.ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		var retry bool
+		if retry, err = writer.post(body); err == nil || !retry {
+			return err
+		}
+	}
+
+	return fmt.Errorf("remote write failed after %d retries: %v", writer.retries, err)
+}
+
+// post a compressed request, return whether to retry on error
+func (writer *RemoteWriter) post(body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(writer.ctx, http.MethodPost, writer.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range writer.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "gexporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := writer.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("remote write server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// parse http headers like "Authorization=Bearer xxx,X-Scope-OrgID=1"
+func ParseHttpHeaders(headers string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, header := range strings.Split(headers, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		kv := strings.SplitN(header, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.New("header must be name=value: " + header)
+		}
+		parsed[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return parsed, nil
+}
+
+// flatten families to series, histograms and summaries are split
+// into _bucket/_sum/_count series like the text exposition
+func familiesToSeries(families []*dto.MetricFamily, instance string, now time.Time) []*remoteWriteSeries {
+	seriesSlice := make([]*remoteWriteSeries, 0)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...*dto.LabelPair) {
+				seriesSlice = append(seriesSlice, &remoteWriteSeries{
+					Labels:  seriesLabels(name, instance, metric.GetLabel(), extra...),
+					Samples: []remoteWriteSample{{Value: value, Timestamp: timestamp}},
+				})
+			}
+
+			name := family.GetName()
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), labelPair("le", formatFloat(bucket.GetUpperBound())))
+				}
+				add(name+"_bucket", float64(histogram.GetSampleCount()), labelPair("le", "+Inf"))
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add(name, quantile.GetValue(), labelPair("quantile", formatFloat(quantile.GetQuantile())))
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			}
+		}
+	}
+
+	return seriesSlice
+}
+
+// __name__, instance and metric labels sorted by name
+func seriesLabels(name string, instance string, labels []*dto.LabelPair, extra ...*dto.LabelPair) []*dto.LabelPair {
+	pairs := []*dto.LabelPair{labelPair("__name__", name)}
+	pairs = append(pairs, labels...)
+	pairs = append(pairs, extra...)
+	hasInstance := false
+	for _, pair := range pairs {
+		hasInstance = hasInstance || pair.GetName() == "instance"
+	}
+	if !hasInstance && instance != "" {
+		pairs = append(pairs, labelPair("instance", instance))
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].GetName() < pairs[j].GetName()
+	})
+
+	return pairs
+}
+
+func labelPair(name string, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: &name, Value: &value}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteRequest { repeated TimeSeries timeseries = 1; }
+// TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+// Label { string name = 1; string value = 2; }
+// Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(seriesSlice []*remoteWriteSeries) []byte {
+	var request []byte
+	for _, series := range seriesSlice {
+		var ts []byte
+		for _, pair := range series.Labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, pair.GetName())
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, pair.GetValue())
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		for _, s := range series.Samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+		}
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+
+	return request
+}
@@ -0,0 +1,154 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// a decoded protobuf field, Bytes holds length delimited values
+type protoField struct {
+	Num     protowire.Number
+	Type    protowire.Type
+	Varint  uint64
+	Fixed64 uint64
+	Bytes   []byte
+}
+
+// decode the top level fields of a protobuf message
+func decodeProtoFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	fields := make([]protoField, 0)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		field := protoField{Num: num, Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			field.Varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			field.Fixed64, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			field.Bytes, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func TestEncodeWriteRequestGolden(t *testing.T) {
+	request := encodeWriteRequest([]*remoteWriteSeries{{
+		Labels:  []*dto.LabelPair{labelPair("__name__", "up")},
+		Samples: []remoteWriteSample{{Value: 1, Timestamp: 1000}},
+	}})
+
+	want, _ := hex.DecodeString("0a1e" +
+		"0a0e" + "0a085f5f6e616d655f5f" + "12027570" +
+		"120c" + "09000000000000f03f" + "10e807")
+	if !bytes.Equal(request, want) {
+		t.Errorf("encodeWriteRequest() = %x, want %x", request, want)
+	}
+}
+
+func TestEncodeWriteRequestRoundTrip(t *testing.T) {
+	snapshot := testSnapshot(t)
+	snapshot.Time = time.Unix(1600000000, 0)
+	request := encodeWriteRequest(familiesToSeries(snapshot.Families, "h1", snapshot.Time))
+
+	timeseries := decodeProtoFields(t, request)
+	if len(timeseries) != 1 || timeseries[0].Num != 1 {
+		t.Fatalf("timeseries = %+v, want one field 1", timeseries)
+	}
+
+	labels := make([][2]string, 0)
+	samples := make([]protoField, 0)
+	for _, field := range decodeProtoFields(t, timeseries[0].Bytes) {
+		switch field.Num {
+		case 1:
+			pair := decodeProtoFields(t, field.Bytes)
+			if len(pair) != 2 || pair[0].Num != 1 || pair[1].Num != 2 {
+				t.Fatalf("label = %+v, want name 1 and value 2", pair)
+			}
+			labels = append(labels, [2]string{string(pair[0].Bytes), string(pair[1].Bytes)})
+		case 2:
+			samples = append(samples, field)
+		default:
+			t.Fatalf("unexpected series field %d", field.Num)
+		}
+	}
+
+	wantLabels := [][2]string{
+		{"__name__", "process_workload_usage"},
+		{"command", "nginx"},
+		{"instance", "h1"},
+		{"pid", "42"},
+		{"type", "cpu"},
+	}
+	if len(labels) != len(wantLabels) {
+		t.Fatalf("labels = %v, want %v", labels, wantLabels)
+	}
+	for i := range wantLabels {
+		if labels[i] != wantLabels[i] {
+			t.Errorf("label %d = %v, want %v", i, labels[i], wantLabels[i])
+		}
+	}
+
+	if len(samples) != 1 {
+		t.Fatalf("samples = %d, want 1", len(samples))
+	}
+	sample := decodeProtoFields(t, samples[0].Bytes)
+	if len(sample) != 2 || sample[0].Num != 1 || sample[0].Type != protowire.Fixed64Type || sample[1].Num != 2 || sample[1].Type != protowire.VarintType {
+		t.Fatalf("sample = %+v, want double value 1 and int64 timestamp 2", sample)
+	}
+	if value := math.Float64frombits(sample[0].Fixed64); value != 12.5 {
+		t.Errorf("value = %v, want 12.5", value)
+	}
+	if timestamp := int64(sample[1].Varint); timestamp != 1600000000000 {
+		t.Errorf("timestamp = %d, want 1600000000000", timestamp)
+	}
+}
+
+func TestRemoteWriterStopTimeout(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	writer := NewRemoteWriter(server.URL, nil, "h1", 1, 10, 100, time.Millisecond*200)
+	snapshot := testSnapshot(t)
+	for i := 0; i < 3; i++ {
+		if err := writer.Send(snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first batch is retried until the deadline, the rest are dropped
+	start := time.Now()
+	writer.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("Stop took %s, want about the stop timeout", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n == 0 {
+		t.Error("no batch was sent before the deadline")
+	}
+}
@@ -3,24 +3,33 @@
 package exporter
 
 import (
+	"context"
+	"flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	logtax "log"
+	"os"
+	"os/signal"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 var (
 	ticker               *time.Ticker
 	stracePids           = make(map[int32]bool)
-	CpuOb                = NewCpuOb()
-	MemoryOb             = NewMemoryOb()
-	gTimeChan            = make(chan float64, 0)
-	gCountDown int32     = 0
-	gMtx                 = sync.Mutex{}
+	stracePidsMtx        = sync.Mutex{}
+	CpuOb                *CpuInfo
+	MemoryOb             *MemoryInfo
 )
 
 // collect entry
 func CollectWorkLoadUsage() {
+	// config errors panic to stderr, the log file is not read at startup
+	gExporterConfig = NewExporterConfig(flag.CommandLine, os.Args[1:])
+	CpuOb = NewCpuOb()
+	MemoryOb = NewMemoryOb()
+
 	// log panic
 	defer func() {
 		if v := recover(); v != nil {
@@ -29,36 +38,72 @@ func CollectWorkLoadUsage() {
 	}()
 
 	timeUseGaugeVec := GetGaugeVec("scrape_time_use", "scrape time use", []string{})
+	// canceled on shutdown, interrupting the in flight update and strace
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	coordinator, err := NewScrapeCoordinator(ctx, gExporterConfig.Configs["collectors"].([]string), gExporterConfig.Configs["collector_timeouts"].(map[string]time.Duration))
+	if err != nil {
+		logtax.Fatal(err.Error())
+	}
+	prometheus.MustRegister(coordinator)
+	// held by the in flight update, taken on shutdown to wait for it
+	updateMtx := sync.Mutex{}
+	update := func() {
+		updateMtx.Lock()
+		defer updateMtx.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		timeUseStart := float64(time.Now().UnixNano()) / 1e6
+		// run all collectors
+		coordinator.Update(ctx)
+		// time use
+		timeUseStop := float64(time.Now().UnixNano()) / 1e6
+		timeUse := timeUseStop - timeUseStart
+		timeUseGaugeVec.WithLabelValues().Set(timeUse)
+	}
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<- shutdown
+		cancel()
+	}()
+
+	// collect on /metrics requests, only the expose exporter is allowed
+	if gExporterConfig.Configs["collect_mode"].(string) == "scrape" {
+		scraper := NewOnDemandScraper(update, gExporterConfig.Configs["collect_timeout"].(time.Duration), gExporterConfig.Configs["collect_cache_ttl"].(time.Duration))
+		go PromHttpServerStart(scraper.Handler(promhttp.Handler()))
+		<- ctx.Done()
+		updateMtx.Lock()
+		coordinator.Wait()
+		return
+	}
+
 	ticker = time.NewTicker(time.Second * time.Duration(gExporterConfig.getConfig("scrape_interval").(int)))
+	sinkSlice, err := NewSinksFromConfig()
+	if err != nil {
+		logtax.Fatal(err.Error())
+	}
+	// a send taking longer than the interval would delay the next update
+	sinks := NewSinkFanOut(sinkSlice, time.Second * time.Duration(gExporterConfig.getConfig("scrape_interval").(int)))
 	for {
 		select {
+		case <- ctx.Done():
+			// the update runs in this loop, only collectors it left
+			// running may be in flight here
+			coordinator.Wait()
+			ticker.Stop()
+			sinks.Close()
+			return
 		case <- ticker.C:
-			timeUseStart := float64(time.Now().UnixNano()) / 1e6
-			// cpu usage
-			go CpuOb.CalCpuUsage()
-			// load average
-			go CpuOb.LoadAverage()
-			// uss memory usage
-			go MemoryOb.ExposeUssMemoryUsage()
-			// time use
-			timeUseStop := <- gTimeChan
-			timeUse := timeUseStop - timeUseStart
-			timeUseGaugeVec.WithLabelValues().Set(timeUse)
+			update()
+			// send to sinks
+			snapshot, err := GatherSnapshot(prometheus.DefaultGatherer)
+			if err != nil {
+				logtax.Println(err.Error())
+				continue
+			}
+			sinks.Send(snapshot)
 		}
 	}
 }
-
-func timeUseCondition() {
-	atomic.AddInt32(&gCountDown, 1)
-	gMtx.Lock()
-	if gCountDown == 3 {
-		gTimeChan <- float64(time.Now().UnixNano()) / 1e6
-		gCountDown = 0
-	}
-	gMtx.Unlock()
-}
-
-// expose metrics to pushgateway
-func NormalUsagePushGateway(indicator *Indicator) {
-
-}
@@ -0,0 +1,100 @@
+// track series of a gauge vec between scrape rounds
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	logtax "log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// series tracker remembers the label sets set during a round, deletes
+// the ones not set again when the round is flushed, and caps the number
+// of distinct series per type label
+type SeriesTracker struct {
+	vec       *prometheus.GaugeVec
+	maxSeries int
+	mtx       sync.Mutex
+	current   map[string]prometheus.Labels
+	previous  map[string]prometheus.Labels
+	types     map[string]int
+	dropped   bool
+}
+
+// maxSeries 0 means unlimited
+func NewSeriesTracker(vec *prometheus.GaugeVec, maxSeries int) *SeriesTracker {
+	return &SeriesTracker{
+		vec:       vec,
+		maxSeries: maxSeries,
+		current:   make(map[string]prometheus.Labels),
+		previous:  make(map[string]prometheus.Labels),
+		types:     make(map[string]int),
+	}
+}
+
+// set a series value, return false if it is a new series over the cap
+func (tracker *SeriesTracker) Set(labels prometheus.Labels, value float64) bool {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	key := seriesKey(labels)
+	if _, ok := tracker.current[key]; !ok {
+		if tracker.maxSeries > 0 && tracker.types[labels["type"]] >= tracker.maxSeries {
+			// once per round, the rest of the round is dropped alike
+			if !tracker.dropped {
+				tracker.dropped = true
+				logtax.Printf("series cap %d reached, dropping %v", tracker.maxSeries, labels)
+			}
+			return false
+		}
+		tracker.current[key] = labels
+		tracker.types[labels["type"]]++
+	}
+	tracker.vec.With(labels).Set(value)
+
+	return true
+}
+
+// end the round, series not set during it are deleted
+func (tracker *SeriesTracker) Flush() {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+
+	for key, labels := range tracker.previous {
+		if _, ok := tracker.current[key]; !ok {
+			tracker.vec.Delete(labels)
+		}
+	}
+	tracker.previous, tracker.current = tracker.current, make(map[string]prometheus.Labels)
+	tracker.types = make(map[string]int)
+	tracker.dropped = false
+}
+
+// label values joined in label name order
+func seriesKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(labels[name])
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// the tracker collects its vec
+func (tracker *SeriesTracker) Describe(ch chan<- *prometheus.Desc) {
+	tracker.vec.Describe(ch)
+}
+
+func (tracker *SeriesTracker) Collect(ch chan<- prometheus.Metric) {
+	tracker.vec.Collect(ch)
+}
@@ -0,0 +1,272 @@
+// output sinks of scrape snapshots
+
+package exporter
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	logtax "log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	SinkBusyErr    = errors.New("previous send still running, snapshot skipped")
+	SinkTimeoutErr = errors.New("send timeout, left running")
+	sinkNames      = []string{"expose", "pushgateway", "remote_write", "influx", "statsd", "graphite", "otlp", "textfile"}
+)
+
+// metrics gathered after a completed scrape
+type Snapshot struct {
+	Time     time.Time
+	Families []*dto.MetricFamily
+}
+
+// sink receives every completed scrape snapshot
+type Sink interface {
+	Name() string
+	Send(snapshot *Snapshot) error
+	// called once on shutdown
+	Close() error
+}
+
+// sink fan out sends snapshots to all sinks concurrently, waiting for
+// each at most the timeout, errors are counted per sink
+type SinkFanOut struct {
+	sinks   []Sink
+	timeout time.Duration
+	mtx     sync.Mutex
+	busy    map[string]bool // sinks still sending after a timeout
+	wg      sync.WaitGroup  // running sends
+}
+
+// expose sink serves the registry over http, snapshots are not needed
+type exposeSink struct{}
+
+// parse exporters like "expose,pushgateway"
+func ParseSinkNames(exporters string) ([]string, error) {
+	names := make([]string, 0)
+	for _, name := range strings.Split(exporters, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		supported := false
+		for _, sinkName := range sinkNames {
+			supported = supported || name == sinkName
+		}
+		if !supported {
+			return nil, errors.New("unsupport exporter " + name)
+		}
+		for _, n := range names {
+			if n == name {
+				return nil, errors.New("duplicated exporter " + name)
+			}
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("exporter required")
+	}
+
+	return names, nil
+}
+
+// create the sinks of the config
+func NewSinksFromConfig() ([]Sink, error) {
+	sinks := make([]Sink, 0)
+	for _, name := range gExporterConfig.Configs["exporter"].([]string) {
+		switch name {
+		case "expose":
+			sinks = append(sinks, NewExposeSink())
+		case "pushgateway":
+			sinks = append(sinks, NewPushGatewayPusher(
+				gExporterConfig.Configs["pushgateway_url"].(string),
+				gExporterConfig.Configs["pushgateway_job"].(string),
+				gExporterConfig.Configs["pushgateway_instance"].(string),
+				gExporterConfig.Configs["pushgateway_method"].(string),
+				gExporterConfig.Configs["pushgateway_retries"].(int),
+				gExporterConfig.Configs["pushgateway_delete_on_shutdown"].(bool),
+			))
+		case "remote_write":
+			sinks = append(sinks, NewRemoteWriter(
+				gExporterConfig.Configs["remote_write_url"].(string),
+				gExporterConfig.Configs["remote_write_headers"].(map[string]string),
+				gExporterConfig.Configs["remote_write_instance"].(string),
+				gExporterConfig.Configs["remote_write_batch_size"].(int),
+				gExporterConfig.Configs["remote_write_queue_size"].(int),
+				gExporterConfig.Configs["remote_write_retries"].(int),
+				time.Second*time.Duration(gExporterConfig.Configs["scrape_interval"].(int)),
+			))
+		case "influx":
+			sink, err := NewInfluxSink(
+				gExporterConfig.Configs["influx_url"].(string),
+				gExporterConfig.Configs["influx_host"].(string),
+				gExporterConfig.Configs["influx_batch_size"].(int),
+			)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "statsd":
+			sink, err := NewStatsdSink(
+				gExporterConfig.Configs["statsd_address"].(string),
+				gExporterConfig.Configs["statsd_prefix"].(string),
+				gExporterConfig.Configs["statsd_sample_rate"].(float64),
+				gExporterConfig.Configs["statsd_tags"].(bool),
+			)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "graphite":
+			sinks = append(sinks, NewGraphiteSink(
+				gExporterConfig.Configs["graphite_address"].(string),
+				gExporterConfig.Configs["graphite_host"].(string),
+				gExporterConfig.Configs["graphite_template"].(string),
+				gExporterConfig.Configs["graphite_templates"].(map[string]string),
+				gExporterConfig.Configs["graphite_buffer_size"].(int),
+			))
+		case "otlp":
+			sinks = append(sinks, NewOtlpExporter(
+				gExporterConfig.Configs["otlp_url"].(string),
+				gExporterConfig.Configs["otlp_headers"].(map[string]string),
+				gExporterConfig.Configs["otlp_host"].(string),
+				gExporterConfig.Configs["otlp_retries"].(int),
+			))
+		case "textfile":
+			sinks = append(sinks, NewTextfileSink(
+				gExporterConfig.Configs["textfile_directory"].(string),
+				gExporterConfig.Configs["textfile_name"].(string),
+			))
+		}
+	}
+
+	return sinks, nil
+}
+
+func NewSinkFanOut(sinks []Sink, timeout time.Duration) *SinkFanOut {
+	return &SinkFanOut{
+		sinks:   sinks,
+		timeout: timeout,
+		busy:    make(map[string]bool, len(sinks)),
+	}
+}
+
+// gather the registry into a snapshot
+func GatherSnapshot(gatherer prometheus.Gatherer) (*Snapshot, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Time: time.Now(), Families: families}, nil
+}
+
+// send a snapshot to all sinks and wait for them, each at most the
+// timeout, a sink still sending is left running and skips snapshots
+// until it returns, so a hung sink does not stall collection
+func (fanOut *SinkFanOut) Send(snapshot *Snapshot) {
+	wg := sync.WaitGroup{}
+	for _, sink := range fanOut.sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			sinkSendsCounterVec.WithLabelValues(sink.Name()).Inc()
+			if err := fanOut.send(sink, snapshot); err != nil {
+				sinkErrorsCounterVec.WithLabelValues(sink.Name()).Inc()
+				logtax.Println(sink.Name() + ": " + err.Error())
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
+
+func (fanOut *SinkFanOut) send(sink Sink, snapshot *Snapshot) error {
+	fanOut.mtx.Lock()
+	if fanOut.busy[sink.Name()] {
+		fanOut.mtx.Unlock()
+		return SinkBusyErr
+	}
+	fanOut.busy[sink.Name()] = true
+	fanOut.mtx.Unlock()
+
+	result := make(chan error, 1)
+	fanOut.wg.Add(1)
+	go func() {
+		defer fanOut.wg.Done()
+		err := sink.Send(snapshot)
+		fanOut.mtx.Lock()
+		fanOut.busy[sink.Name()] = false
+		fanOut.mtx.Unlock()
+		result <- err
+	}()
+
+	timer := time.NewTimer(fanOut.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return SinkTimeoutErr
+	}
+}
+
+// close all sinks, sends left running are waited for at most the timeout
+func (fanOut *SinkFanOut) Close() {
+	done := make(chan struct{})
+	go func() {
+		fanOut.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(fanOut.timeout):
+		logtax.Println(SinkTimeoutErr.Error() + " on close")
+	}
+
+	for _, sink := range fanOut.sinks {
+		if err := sink.Close(); err != nil {
+			logtax.Println(sink.Name() + ": " + err.Error())
+		}
+	}
+}
+
+// start the http server exposing the registry
+func NewExposeSink() *exposeSink {
+	go PromHttpServerStart(promhttp.Handler())
+	return &exposeSink{}
+}
+
+func (sink *exposeSink) Name() string {
+	return "expose"
+}
+
+func (sink *exposeSink) Send(snapshot *Snapshot) error {
+	return nil
+}
+
+func (sink *exposeSink) Close() error {
+	return nil
+}
+
+// a gatherer returning the families of the last snapshot
+type snapshotGatherer struct {
+	mtx      sync.Mutex
+	families []*dto.MetricFamily
+}
+
+func (gatherer *snapshotGatherer) set(snapshot *Snapshot) {
+	gatherer.mtx.Lock()
+	gatherer.families = snapshot.Families
+	gatherer.mtx.Unlock()
+}
+
+func (gatherer *snapshotGatherer) Gather() ([]*dto.MetricFamily, error) {
+	gatherer.mtx.Lock()
+	defer gatherer.mtx.Unlock()
+	return gatherer.families, nil
+}
@@ -0,0 +1,56 @@
+package exporter
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sink blocking every send until release is closed
+type blockingSink struct {
+	name    string
+	release chan struct{}
+	sends   int32
+}
+
+func (sink *blockingSink) Name() string {
+	return sink.name
+}
+
+func (sink *blockingSink) Send(snapshot *Snapshot) error {
+	atomic.AddInt32(&sink.sends, 1)
+	<-sink.release
+	return nil
+}
+
+func (sink *blockingSink) Close() error {
+	return nil
+}
+
+func TestSinkFanOutHungSink(t *testing.T) {
+	hung := &blockingSink{name: "hung", release: make(chan struct{})}
+	fast := &blockingSink{name: "fast", release: make(chan struct{})}
+	close(fast.release)
+	fanOut := NewSinkFanOut([]Sink{hung, fast}, time.Millisecond*50)
+
+	start := time.Now()
+	fanOut.Send(testSnapshot(t))
+	fanOut.Send(testSnapshot(t))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Send blocked for %s on a hung sink", elapsed)
+	}
+	// the second snapshot is skipped while the first send is running
+	if sends := atomic.LoadInt32(&hung.sends); sends != 1 {
+		t.Errorf("hung sink sends = %d, want 1", sends)
+	}
+	if sends := atomic.LoadInt32(&fast.sends); sends != 2 {
+		t.Errorf("fast sink sends = %d, want 2", sends)
+	}
+
+	close(hung.release)
+	fanOut.Close()
+	fanOut.Send(testSnapshot(t))
+	if sends := atomic.LoadInt32(&hung.sends); sends != 2 {
+		t.Errorf("hung sink sends after release = %d, want 2", sends)
+	}
+}
@@ -0,0 +1,184 @@
+// send metrics as statsd gauges
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// fits in an ethernet mtu, like most statsd clients
+	statsdUdpMaxPayload      = 1432
+	statsdUnixgramMaxPayload = 8192
+)
+
+var (
+	statsdNameEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
+
+// statsd sink writes snapshots as gauges to a statsd agent over udp or
+// a unix datagram socket, labels become dogstatsd tags when enabled,
+// or are appended to the metric name otherwise
+type StatsdSink struct {
+	network    string
+	address    string
+	conn       net.Conn // nil until dialed and after a failed write
+	prefix     string
+	sampleRate float64
+	tags       bool
+	maxPayload int
+}
+
+// address is udp://host:port or unixgram:///path/to/socket, the socket
+// is dialed on the first send so the agent may start later
+func NewStatsdSink(address string, prefix string, sampleRate float64, tags bool) (*StatsdSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &StatsdSink{
+		prefix:     prefix,
+		sampleRate: sampleRate,
+		tags:       tags,
+	}
+	switch u.Scheme {
+	case "udp":
+		sink.maxPayload = statsdUdpMaxPayload
+		sink.network, sink.address = "udp", u.Host
+	case "unixgram":
+		sink.maxPayload = statsdUnixgramMaxPayload
+		sink.network, sink.address = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("unsupport statsd address scheme %q", u.Scheme)
+	}
+
+	return sink, nil
+}
+
+func (sink *StatsdSink) Name() string {
+	return "statsd"
+}
+
+// write a snapshot, lines are packed into packets up to the max payload,
+// the socket is dialed again after a failed write
+func (sink *StatsdSink) Send(snapshot *Snapshot) error {
+	if sink.conn == nil {
+		conn, err := net.Dial(sink.network, sink.address)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+
+	var (
+		packet  bytes.Buffer
+		lastErr error
+	)
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := sink.conn.Write(packet.Bytes()); err != nil {
+			lastErr = err
+		}
+		packet.Reset()
+	}
+
+	for _, line := range sink.lines(snapshot) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > sink.maxPayload {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+
+	if lastErr != nil {
+		_ = sink.conn.Close()
+		sink.conn = nil
+	}
+	return lastErr
+}
+
+func (sink *StatsdSink) Close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
+
+// name:value|g[|@rate][|#tag:v,...] for every sampled metric,
+// histograms and summaries are sent as their sum and count
+func (sink *StatsdSink) lines(snapshot *Snapshot) []string {
+	lines := make([]string, 0)
+	for _, family := range snapshot.Families {
+		for _, metric := range family.GetMetric() {
+			if sink.sampleRate < 1 && rand.Float64() >= sink.sampleRate {
+				continue
+			}
+
+			values := make(map[string]float64)
+			switch family.GetType() {
+			case dto.MetricType_GAUGE:
+				values[""] = metric.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				values[""] = metric.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				values[""] = metric.GetUntyped().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				values[".sum"] = metric.GetHistogram().GetSampleSum()
+				values[".count"] = float64(metric.GetHistogram().GetSampleCount())
+			case dto.MetricType_SUMMARY:
+				values[".sum"] = metric.GetSummary().GetSampleSum()
+				values[".count"] = float64(metric.GetSummary().GetSampleCount())
+			}
+
+			for suffix, value := range values {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					continue
+				}
+				lines = append(lines, sink.line(family.GetName()+suffix, metric.GetLabel(), value))
+			}
+		}
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+func (sink *StatsdSink) line(name string, labels []*dto.LabelPair, value float64) string {
+	name = sink.prefix + name
+	tags := make([]string, 0, len(labels))
+	for _, pair := range labels {
+		if pair.GetValue() == "" {
+			continue
+		}
+		if sink.tags {
+			tags = append(tags, statsdNameEscaper.Replace(pair.GetName())+":"+statsdNameEscaper.Replace(pair.GetValue()))
+		} else {
+			name += "." + strings.ReplaceAll(pair.GetValue(), ".", "_")
+		}
+	}
+
+	line := statsdNameEscaper.Replace(name) + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|g"
+	if sink.sampleRate < 1 {
+		line += "|@" + strconv.FormatFloat(sink.sampleRate, 'f', -1, 64)
+	}
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	return line
+}
@@ -0,0 +1,157 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestStatsdLine(t *testing.T) {
+	labels := []*dto.LabelPair{
+		labelPair("command", "nginx: worker"),
+		labelPair("pid", "42"),
+		labelPair("empty", ""),
+		labelPair("version", "1.2"),
+	}
+	cases := []struct {
+		name       string
+		tags       bool
+		sampleRate float64
+		want       string
+	}{
+		{
+			name:       "name parts",
+			sampleRate: 1,
+			want:       "gexporter.up.nginx__worker.42.1_2:1.5|g",
+		},
+		{
+			name:       "tags",
+			tags:       true,
+			sampleRate: 1,
+			want:       "gexporter.up:1.5|g|#command:nginx__worker,pid:42,version:1.2",
+		},
+		{
+			name:       "sample rate",
+			tags:       true,
+			sampleRate: 0.5,
+			want:       "gexporter.up:1.5|g|@0.5|#command:nginx__worker,pid:42,version:1.2",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sink, err := NewStatsdSink("udp://127.0.0.1:8125", "gexporter.", c.sampleRate, c.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sink.line("up", labels, 1.5); got != c.want {
+				t.Errorf("line() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// snapshot of a gauge with n series
+func statsdTestSnapshot(t *testing.T, n int) *Snapshot {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "process_workload_usage",
+		Help: "test usage",
+	}, []string{"pid"})
+	registry.MustRegister(vec)
+	for i := 0; i < n; i++ {
+		vec.WithLabelValues(strconv.Itoa(i)).Set(float64(i))
+	}
+
+	snapshot, err := GatherSnapshot(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestStatsdSinkUdpSplit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewStatsdSink("udp://"+conn.LocalAddr().String(), "", 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.maxPayload = 100
+
+	if err := sink.Send(statsdTestSnapshot(t, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := 0
+	buf := make([]byte, statsdUdpMaxPayload)
+	for lines < 20 {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("after %d lines: %v", lines, err)
+		}
+		if n > sink.maxPayload {
+			t.Errorf("packet of %d bytes over the max payload %d", n, sink.maxPayload)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if !strings.HasPrefix(line, "process_workload_usage:") || !strings.Contains(line, "|g|#pid:") {
+				t.Errorf("line = %q", line)
+			}
+			lines++
+		}
+	}
+	if lines != 20 {
+		t.Errorf("lines = %d, want 20", lines)
+	}
+}
+
+func TestStatsdSinkUnixgramRedial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+	// the agent is not listening yet
+	sink, err := NewStatsdSink("unixgram://"+path, "gexporter.", 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send(testSnapshot(t)); err == nil {
+		t.Fatal("Send() succeeded without a socket")
+	}
+
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sink.Send(testSnapshot(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, statsdUnixgramMaxPayload)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet, want := string(buf[:n]), "gexporter.process_workload_usage.nginx.42.cpu:12.5|g"; packet != want {
+		t.Errorf("packet = %q, want %q", packet, want)
+	}
+}
@@ -0,0 +1,72 @@
+// read hardware information from sysfs
+
+package exporter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	sysFsPath   = "/sys"
+	cpuDirRegex = regexp.MustCompile(`^cpu\d+$`)
+)
+
+// cpu topology counted from /sys/devices/system/cpu
+type CpuTopology struct {
+	Sockets int // unique physical packages
+	Cores   int // unique (package, core) pairs
+	Threads int // logical cpus
+}
+
+// path under sysfs
+func sysFile(elem ...string) string {
+	return filepath.Join(append([]string{sysFsPath}, elem...)...)
+}
+
+// read cpu topology, cpus without topology info (offline) are skipped
+func ReadCpuTopology() (*CpuTopology, error) {
+	cpuDir := sysFile("devices", "system", "cpu")
+	entries, err := ioutil.ReadDir(cpuDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		topology = &CpuTopology{}
+		sockets  = make(map[string]bool)
+		cores    = make(map[string]bool)
+	)
+	for _, entry := range entries {
+		if !cpuDirRegex.MatchString(entry.Name()) {
+			continue
+		}
+		packageId, err := readSysValue(filepath.Join(cpuDir, entry.Name(), "topology", "physical_package_id"))
+		if err != nil {
+			continue
+		}
+		coreId, err := readSysValue(filepath.Join(cpuDir, entry.Name(), "topology", "core_id"))
+		if err != nil {
+			continue
+		}
+
+		sockets[packageId] = true
+		cores[packageId+":"+coreId] = true
+		topology.Threads++
+	}
+	topology.Sockets = len(sockets)
+	topology.Cores = len(cores)
+
+	return topology, nil
+}
+
+// read a single value sysfs file
+func readSysValue(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,98 @@
+// write metrics for node_exporter textfile collector
+
+package exporter
+
+import (
+	"bufio"
+	"github.com/prometheus/common/expfmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// metrics of the go and process collectors, node_exporter exposes its own
+	textfileSkipPrefixes = []string{"go_", "promhttp_"}
+	textfileSkipNames    = map[string]bool{
+		"process_cpu_seconds_total":        true,
+		"process_open_fds":                 true,
+		"process_max_fds":                  true,
+		"process_virtual_memory_bytes":     true,
+		"process_virtual_memory_max_bytes": true,
+		"process_resident_memory_bytes":    true,
+		"process_start_time_seconds":       true,
+	}
+)
+
+// textfile sink writes each snapshot in text exposition format to a
+// temp file in the directory and renames it to the .prom file, so the
+// textfile collector never reads a partial file
+type TextfileSink struct {
+	directory string
+	path      string
+}
+
+func NewTextfileSink(directory string, name string) *TextfileSink {
+	return &TextfileSink{
+		directory: directory,
+		path:      filepath.Join(directory, name),
+	}
+}
+
+func (sink *TextfileSink) Name() string {
+	return "textfile"
+}
+
+func (sink *TextfileSink) Send(snapshot *Snapshot) error {
+	// not ending with .prom, the collector ignores it
+	file, err := ioutil.TempFile(sink.directory, "."+filepath.Base(sink.path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	for _, family := range snapshot.Families {
+		if textfileSkip(family.GetName()) {
+			continue
+		}
+		if _, err = expfmt.MetricFamilyToText(writer, family); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), sink.path)
+}
+
+// remove the file, stale metrics would be exposed forever otherwise
+func (sink *TextfileSink) Close() error {
+	if err := os.Remove(sink.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func textfileSkip(name string) bool {
+	for _, prefix := range textfileSkipPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return textfileSkipNames[name]
+}